@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	ACK_AUTO              = "auto"
+	ACK_CLIENT            = "client"
+	ACK_CLIENT_INDIVIDUAL = "client-individual"
+)
+
+func validateAckMode(mode string) bool {
+	switch mode {
+	case ACK_AUTO, ACK_CLIENT, ACK_CLIENT_INDIVIDUAL:
+		return true
+	default:
+		return false
+	}
+}
+
+// PendingMessage is a MESSAGE frame delivered to a subscription in client or
+// client-individual ack mode that has not yet been ACKed or NACKed
+type PendingMessage struct {
+	ackID       string
+	subID       string
+	ackMode     string
+	destination string
+	frame       Frame
+}
+
+// AckManager tracks unacknowledged messages per client, in delivery order.
+// SendWorkers add to it concurrently with the engine resolving ACK and NACK frames,
+// so access is protected by a mutex.
+type AckManager struct {
+	mu      sync.Mutex
+	pending map[string][]PendingMessage
+}
+
+func NewAckManager() *AckManager {
+	return &AckManager{
+		pending: make(map[string][]PendingMessage),
+	}
+}
+
+// Add records a message delivered to clientID that is awaiting acknowledgement
+func (am *AckManager) Add(clientID string, pm PendingMessage) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.pending[clientID] = append(am.pending[clientID], pm)
+}
+
+// Ack resolves the message with ackID and returns every message it acknowledges.
+// In client mode this is cumulative: all earlier messages on the same subscription are included.
+// subID narrows the search to one subscription and may be empty; STOMP 1.0 and 1.1 clients
+// acknowledge by message-id, which is not unique across a client's subscriptions.
+func (am *AckManager) Ack(clientID, subID, ackID string) ([]PendingMessage, error) {
+	return am.resolve(clientID, subID, ackID)
+}
+
+// Nack resolves the message with ackID the same way Ack does; the caller is
+// responsible for redelivering the returned messages
+func (am *AckManager) Nack(clientID, subID, ackID string) ([]PendingMessage, error) {
+	return am.resolve(clientID, subID, ackID)
+}
+
+// IsPending reports whether Ack or Nack would find the message with ackID
+func (am *AckManager) IsPending(clientID, subID, ackID string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	for _, pm := range am.pending[clientID] {
+		if pm.ackID == ackID && (subID == "" || pm.subID == subID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (am *AckManager) resolve(clientID, subID, ackID string) ([]PendingMessage, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	msgs := am.pending[clientID]
+	target := -1
+	for i := range msgs {
+		if msgs[i].ackID == ackID && (subID == "" || msgs[i].subID == subID) {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		return nil, fmt.Errorf("no pending message with ack ID %s for client %s", ackID, clientID)
+	}
+
+	resolved := make([]PendingMessage, 0)
+	remaining := make([]PendingMessage, 0, len(msgs))
+	for i := range msgs {
+		if i == target {
+			resolved = append(resolved, msgs[i])
+		} else if i < target && msgs[target].ackMode == ACK_CLIENT && msgs[i].subID == msgs[target].subID {
+			resolved = append(resolved, msgs[i])
+		} else {
+			remaining = append(remaining, msgs[i])
+		}
+	}
+	am.setPending(clientID, remaining)
+	return resolved, nil
+}
+
+// PendingCount returns the number of unacknowledged messages on one subscription
+func (am *AckManager) PendingCount(clientID, subID string) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	count := 0
+	for _, pm := range am.pending[clientID] {
+		if pm.subID == subID {
+			count++
+		}
+	}
+	return count
+}
+
+// RemoveSubscription drops and returns all pending messages for one subscription
+func (am *AckManager) RemoveSubscription(clientID, subID string) []PendingMessage {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	removed := make([]PendingMessage, 0)
+	remaining := make([]PendingMessage, 0)
+	for _, pm := range am.pending[clientID] {
+		if pm.subID == subID {
+			removed = append(removed, pm)
+		} else {
+			remaining = append(remaining, pm)
+		}
+	}
+	am.setPending(clientID, remaining)
+	return removed
+}
+
+// RemoveClient drops and returns all pending messages for a client, e.g. on disconnect
+func (am *AckManager) RemoveClient(clientID string) []PendingMessage {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	removed := am.pending[clientID]
+	delete(am.pending, clientID)
+	return removed
+}
+
+// setPending assumes am.mu is held
+func (am *AckManager) setPending(clientID string, msgs []PendingMessage) {
+	if len(msgs) == 0 {
+		delete(am.pending, clientID)
+	} else {
+		am.pending[clientID] = msgs
+	}
+}
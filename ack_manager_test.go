@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAckManager(t *testing.T) {
+	fr := Frame{Command: MESSAGE, Headers: map[string]string{"destination": "/queue/test"}, Body: []byte{}}
+	client := "client1"
+
+	t.Run("_AckClientIndividual", func(t *testing.T) {
+		am := NewAckManager()
+		am.Add(client, PendingMessage{ackID: "a1", subID: "s1", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "a2", subID: "s1", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/queue/test", frame: fr})
+
+		acked, err := am.Ack(client, "", "a2")
+		if err != nil {
+			t.Error("ack error: ", err)
+		}
+		if len(acked) != 1 || acked[0].ackID != "a2" {
+			t.Errorf("wrong messages acked: got %+v", acked)
+		}
+
+		_, err = am.Ack(client, "", "a2")
+		if err == nil {
+			t.Error("duplicate ack allowed")
+		}
+
+		remaining := am.RemoveClient(client)
+		if len(remaining) != 1 || remaining[0].ackID != "a1" {
+			t.Errorf("wrong messages remaining: got %+v", remaining)
+		}
+	})
+
+	t.Run("_AckClientCumulative", func(t *testing.T) {
+		am := NewAckManager()
+		am.Add(client, PendingMessage{ackID: "a1", subID: "s1", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "b1", subID: "s2", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "a2", subID: "s1", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "a3", subID: "s1", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+
+		acked, err := am.Ack(client, "", "a2")
+		if err != nil {
+			t.Error("ack error: ", err)
+		}
+		if len(acked) != 2 || acked[0].ackID != "a1" || acked[1].ackID != "a2" {
+			t.Errorf("wrong messages acked: got %+v", acked)
+		}
+
+		remaining := am.RemoveClient(client)
+		if len(remaining) != 2 || remaining[0].ackID != "b1" || remaining[1].ackID != "a3" {
+			t.Errorf("wrong messages remaining: got %+v", remaining)
+		}
+	})
+
+	t.Run("_Nack", func(t *testing.T) {
+		am := NewAckManager()
+		am.Add(client, PendingMessage{ackID: "a1", subID: "s1", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/queue/test", frame: fr})
+
+		nacked, err := am.Nack(client, "", "a1")
+		if err != nil {
+			t.Error("nack error: ", err)
+		}
+		if len(nacked) != 1 || nacked[0].destination != "/queue/test" {
+			t.Errorf("wrong messages nacked: got %+v", nacked)
+		}
+
+		_, err = am.Nack("otherclient", "", "a1")
+		if err == nil {
+			t.Error("nack allowed for another client's message")
+		}
+	})
+
+	t.Run("_AckBySubscription", func(t *testing.T) {
+		am := NewAckManager()
+		am.Add(client, PendingMessage{ackID: "m1", subID: "s1", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/topic/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "m1", subID: "s2", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/topic/test", frame: fr})
+
+		acked, err := am.Ack(client, "s2", "m1")
+		if err != nil {
+			t.Error("ack error: ", err)
+		}
+		if len(acked) != 1 || acked[0].subID != "s2" {
+			t.Errorf("wrong messages acked: got %+v", acked)
+		}
+
+		_, err = am.Ack(client, "s2", "m1")
+		if err == nil {
+			t.Error("duplicate ack allowed")
+		}
+	})
+
+	t.Run("_PendingCount", func(t *testing.T) {
+		am := NewAckManager()
+		am.Add(client, PendingMessage{ackID: "a1", subID: "s1", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "a2", subID: "s1", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "b1", subID: "s2", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+
+		if c := am.PendingCount(client, "s1"); c != 2 {
+			t.Errorf("wrong pending count: got %d wanted 2", c)
+		}
+		if c := am.PendingCount("otherclient", "s1"); c != 0 {
+			t.Errorf("wrong pending count: got %d wanted 0", c)
+		}
+	})
+
+	t.Run("_RemoveSubscription", func(t *testing.T) {
+		am := NewAckManager()
+		am.Add(client, PendingMessage{ackID: "a1", subID: "s1", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+		am.Add(client, PendingMessage{ackID: "b1", subID: "s2", ackMode: ACK_CLIENT, destination: "/queue/test", frame: fr})
+
+		removed := am.RemoveSubscription(client, "s1")
+		if len(removed) != 1 || removed[0].ackID != "a1" {
+			t.Errorf("wrong messages removed: got %+v", removed)
+		}
+
+		remaining := am.RemoveClient(client)
+		if len(remaining) != 1 || remaining[0].ackID != "b1" {
+			t.Errorf("wrong messages remaining: got %+v", remaining)
+		}
+	})
+}
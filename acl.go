@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// permissions an ACL rule can grant on a destination
+const (
+	PERM_READ   = "read"   // SUBSCRIBE
+	PERM_WRITE  = "write"  // SEND, alone or in a transaction
+	PERM_CREATE = "create" // SUBSCRIBE with create:true on a destination that does not exist yet
+	PERM_ADMIN  = "admin"  // implies every other permission
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// ACLRule grants permissions on the destinations matching Destination to the listed users and groups.
+// Destination is a path.Match pattern, and a trailing /** also matches everything below its prefix.
+// The user * matches every principal, including anonymous ones.
+type ACLRule struct {
+	Users       []string `mapstructure:"users"`
+	Groups      []string `mapstructure:"groups"`
+	Destination string   `mapstructure:"destination"`
+	Permissions []string `mapstructure:"permissions"`
+}
+
+// ACL decides which principals may read, write, create or administer each destination.
+// Nothing is allowed unless a rule grants it.
+type ACL struct {
+	rules  []ACLRule
+	groups map[string][]string // user -> groups the user belongs to
+}
+
+// NewACL validates rules and takes group membership as a map of group name to its users
+func NewACL(rules []ACLRule, groups map[string][]string) (*ACL, error) {
+	for i, rule := range rules {
+		if rule.Destination == "" {
+			return nil, fmt.Errorf("acl rule %d: no destination", i)
+		}
+		if _, err := path.Match(strings.TrimSuffix(rule.Destination, "/**"), ""); err != nil {
+			return nil, fmt.Errorf("acl rule %d: bad destination pattern %s: %v", i, rule.Destination, err)
+		}
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("acl rule %d: no users or groups", i)
+		}
+		for _, g := range rule.Groups {
+			if _, prs := groups[g]; !prs {
+				return nil, fmt.Errorf("acl rule %d: no such group %s", i, g)
+			}
+		}
+		for _, p := range rule.Permissions {
+			switch p {
+			case PERM_READ, PERM_WRITE, PERM_CREATE, PERM_ADMIN:
+			default:
+				return nil, fmt.Errorf("acl rule %d: unknown permission %s", i, p)
+			}
+		}
+	}
+
+	membership := make(map[string][]string)
+	for group, users := range groups {
+		for _, user := range users {
+			membership[user] = append(membership[user], group)
+		}
+	}
+
+	return &ACL{
+		rules:  rules,
+		groups: membership,
+	}, nil
+}
+
+// Allowed reports whether principal holds perm on dest under any rule
+func (a *ACL) Allowed(principal Principal, dest, perm string) bool {
+	for _, rule := range a.rules {
+		if !a.appliesTo(rule, principal) || !matchDestination(rule.Destination, dest) {
+			continue
+		}
+		for _, p := range rule.Permissions {
+			if p == perm || p == PERM_ADMIN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *ACL) appliesTo(rule ACLRule, principal Principal) bool {
+	for _, u := range rule.Users {
+		if u == "*" || u == principal.Name {
+			return true
+		}
+	}
+	if principal.Name == "" {
+		// anonymous principals belong to no group
+		return false
+	}
+	for _, g := range rule.Groups {
+		for _, member := range a.groups[principal.Name] {
+			if g == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDestination matches dest against a path.Match pattern,
+// treating a trailing /** as matching the prefix itself and anything below it
+func matchDestination(pattern, dest string) bool {
+	if prefix := strings.TrimSuffix(pattern, "/**"); prefix != pattern {
+		if ok, _ := path.Match(prefix, dest); ok {
+			return true
+		}
+		// match the prefix against as many leading elements of dest as it has
+		n := len(strings.Split(prefix, "/"))
+		parts := strings.Split(dest, "/")
+		if len(parts) <= n {
+			return false
+		}
+		ok, _ := path.Match(prefix, strings.Join(parts[:n], "/"))
+		return ok
+	}
+	ok, _ := path.Match(pattern, dest)
+	return ok
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchDestination(t *testing.T) {
+	tests := map[string]struct {
+		pattern string
+		dest    string
+		want    bool
+	}{
+		"exact":              {"/queue/main", "/queue/main", true},
+		"exact mismatch":     {"/queue/main", "/queue/second", false},
+		"star":               {"/queue/*", "/queue/main", true},
+		"star one level":     {"/queue/*", "/queue/orders/eu", false},
+		"double star self":   {"/queue/orders/**", "/queue/orders", true},
+		"double star nested": {"/queue/orders/**", "/queue/orders/eu/fr", true},
+		"double star prefix": {"/queue/orders/**", "/queue/ordersx", false},
+		"double star glob":   {"/queue/*/**", "/queue/orders/eu", true},
+		"everything":         {"/**", "/topic/news", true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := matchDestination(tc.pattern, tc.dest)
+			if got != tc.want {
+				t.Errorf("matchDestination(%s, %s) got %v wanted %v", tc.pattern, tc.dest, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	rules := []ACLRule{
+		{Users: []string{"*"}, Destination: "/topic/public/**", Permissions: []string{PERM_READ}},
+		{Users: []string{"alice"}, Destination: "/queue/orders", Permissions: []string{PERM_READ, PERM_WRITE}},
+		{Groups: []string{"ops"}, Destination: "/**", Permissions: []string{PERM_ADMIN}},
+	}
+	groups := map[string][]string{"ops": {"carol"}}
+
+	acl, err := NewACL(rules, groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		user string
+		dest string
+		perm string
+		want bool
+	}{
+		"anonymous read public":   {"", "/topic/public/news", PERM_READ, true},
+		"anonymous write public":  {"", "/topic/public/news", PERM_WRITE, false},
+		"user write own":          {"alice", "/queue/orders", PERM_WRITE, true},
+		"user create own":         {"alice", "/queue/orders", PERM_CREATE, false},
+		"user write other":        {"alice", "/queue/main", PERM_WRITE, false},
+		"other user write":        {"bob", "/queue/orders", PERM_WRITE, false},
+		"group admin implies all": {"carol", "/queue/new", PERM_CREATE, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := acl.Allowed(Principal{Name: tc.user}, tc.dest, tc.perm)
+			if got != tc.want {
+				t.Errorf("Allowed(%q, %s, %s) got %v wanted %v", tc.user, tc.dest, tc.perm, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewACLErrors(t *testing.T) {
+	tests := map[string]ACLRule{
+		"no destination":     {Users: []string{"alice"}, Permissions: []string{PERM_READ}},
+		"bad pattern":        {Users: []string{"alice"}, Destination: "/queue/[", Permissions: []string{PERM_READ}},
+		"no principals":      {Destination: "/queue/main", Permissions: []string{PERM_READ}},
+		"unknown group":      {Groups: []string{"nobody"}, Destination: "/queue/main", Permissions: []string{PERM_READ}},
+		"unknown permission": {Users: []string{"alice"}, Destination: "/queue/main", Permissions: []string{"delete"}},
+	}
+
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewACL([]ACLRule{rule}, map[string][]string{})
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
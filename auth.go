@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+// Principal is the identity a connection acts as once it has authenticated
+type Principal struct {
+	Name string
+}
+
+// Authenticator is consulted by the engine when it handles a CONNECT or STOMP frame
+type Authenticator interface {
+	// Authenticate checks the login and passcode headers of a CONNECT frame
+	// and returns the principal the connection will act as
+	Authenticate(login, passcode string) (Principal, error)
+}
+
+// AnonymousAuthenticator accepts every client, taking the principal name from the login header if one was sent
+type AnonymousAuthenticator struct{}
+
+func (a AnonymousAuthenticator) Authenticate(login, passcode string) (Principal, error) {
+	return Principal{Name: login}, nil
+}
+
+// FileAuthenticator checks passcodes against bcrypt hashes loaded from a users file.
+// The file has one login:hash entry per line, as written by `htpasswd -B`;
+// blank lines and lines starting with # are ignored.
+type FileAuthenticator struct {
+	users map[string][]byte
+	dummy []byte // compared against for unknown logins so they take as long as known ones
+}
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.SplitN(line, ":", 2)
+		if len(tokens) != 2 || tokens[0] == "" {
+			return nil, fmt.Errorf("%s line %d: expected login:hash", path, lineNum)
+		}
+		if _, err := bcrypt.Cost([]byte(tokens[1])); err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid bcrypt hash for %s: %v", path, lineNum, tokens[0], err)
+		}
+		if _, prs := users[tokens[0]]; prs {
+			return nil, fmt.Errorf("%s line %d: duplicate login %s", path, lineNum, tokens[0])
+		}
+		users[tokens[0]] = []byte(tokens[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAuthenticator{
+		users: users,
+		dummy: dummy,
+	}, nil
+}
+
+func (fa *FileAuthenticator) Authenticate(login, passcode string) (Principal, error) {
+	hash, prs := fa.users[login]
+	if !prs {
+		bcrypt.CompareHashAndPassword(fa.dummy, []byte(passcode))
+		return Principal{}, errAuthFailed
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(passcode)) != nil {
+		return Principal{}, errAuthFailed
+	}
+	return Principal{Name: login}, nil
+}
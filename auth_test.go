@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestFileAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("hash error: ", err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	contents := "# stomper users\n\nalice:" + string(hash) + "\n"
+	err = os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal("write error: ", err)
+	}
+
+	fa, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal("load error: ", err)
+	}
+
+	var tests = []struct {
+		login    string
+		passcode string
+		err      bool // set to true if authentication should fail
+	}{
+		{"alice", "secret", false},
+		{"alice", "wrong", true},
+		{"bob", "secret", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		testname := tt.login + "/" + tt.passcode
+		t.Run(testname, func(t *testing.T) {
+			p, err := fa.Authenticate(tt.login, tt.passcode)
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v / wanted error %v\n", err, tt.err)
+			}
+			if err == nil && p.Name != tt.login {
+				t.Errorf("got principal %s wanted %s\n", p.Name, tt.login)
+			}
+		})
+	}
+}
+
+func TestFileAuthenticatorMalformed(t *testing.T) {
+	for _, contents := range []string{"no-hash-here\n", "alice:notbcrypt\n", ":$2a$04$abc\n"} {
+		t.Run(contents, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users")
+			err := os.WriteFile(path, []byte(contents), 0600)
+			if err != nil {
+				t.Fatal("write error: ", err)
+			}
+			_, err = NewFileAuthenticator(path)
+			if err == nil {
+				t.Error("malformed users file accepted")
+			}
+		})
+	}
+}
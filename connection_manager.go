@@ -1,13 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,27 +22,90 @@ import (
 // * need one goroutine to own each connection.
 // * potential type answer: connections map[string]Connection
 
+// how long a client has to complete a TLS handshake
+const handshakeTimeout = 10 * time.Second
+
 // ConnectionManager
 type ConnectionManager struct {
-	listener    net.Listener
+	specs       []*listenerSpec
+	listeners   []net.Listener
 	hostname    string
 	port        int
 	connections map[string]*Connection
 	messages    chan CnxMgrMsg
 	timeout     time.Duration
+	outbound    OutboundConfig
+	maxBodySize int
+	dropped     uint64 // totals from connections that have closed, accessed atomically
+	slow        uint64
+	drained     chan struct{}
 	mu          sync.RWMutex
 }
 
 func NewConnectionManager(hostname string, port int, messages chan CnxMgrMsg, timeout time.Duration) *ConnectionManager {
 	log.Printf("NEW_CONNECTION_MANAGER on %s:%d with timeout %d seconds\n", hostname, port, timeout)
 	return &ConnectionManager{
-		listener:    nil,
+		listeners:   nil,
 		hostname:    hostname,
 		port:        port,
 		connections: make(map[string]*Connection),
 		messages:    messages,
 		timeout:     timeout * time.Second,
+		outbound:    DefaultOutboundConfig,
+		maxBodySize: DefaultMaxBodySize,
+		drained:     make(chan struct{}, 1),
+	}
+}
+
+// Notify returns a channel that receives a value after a connection whose MESSAGE queue
+// was full takes a frame off it. As with Store.Notify, several events may share one value.
+func (cm *ConnectionManager) Notify() <-chan struct{} {
+	return cm.drained
+}
+
+// SetMaxBodySize sets the largest frame body, in bytes, accepted on connections from now on.
+// A larger frame is a parse error, so the client gets an ERROR frame and is disconnected.
+func (cm *ConnectionManager) SetMaxBodySize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("maximum body size must be at least 1, got %d", n)
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.maxBodySize = n
+	return nil
+}
+
+// SetOutbound configures the outbound queues of connections accepted from now on
+func (cm *ConnectionManager) SetOutbound(oc OutboundConfig) error {
+	err := oc.validate()
+	if err != nil {
+		return err
 	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.outbound = oc
+	return nil
+}
+
+// OutboundStats reports the depth of every open connection's outbound queue,
+// and how often the slow consumer policy has dropped frames or closed connections
+func (cm *ConnectionManager) OutboundStats() OutboundStats {
+	stats := OutboundStats{
+		Dropped:      atomic.LoadUint64(&cm.dropped),
+		Disconnected: atomic.LoadUint64(&cm.slow),
+	}
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	for _, c := range cm.connections {
+		depth := c.depth()
+		stats.Queued += depth
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+		stats.Dropped += atomic.LoadUint64(&c.dropped)
+		stats.Disconnected += uint64(atomic.LoadUint32(&c.slow))
+	}
+	return stats
 }
 
 func (cm *ConnectionManager) Hostname() string {
@@ -48,14 +114,37 @@ func (cm *ConnectionManager) Hostname() string {
 	return cm.hostname
 }
 
-func (cm *ConnectionManager) Start() error {
-	l, err := net.Listen("tcp", cm.hostname+":"+strconv.Itoa(cm.port))
+// AddListener validates a listener for the ConnectionManager to accept connections on once started.
+// With no listeners added, it accepts plain TCP on its hostname and port.
+func (cm *ConnectionManager) AddListener(lc ListenerConfig) error {
+	spec, err := newListenerSpec(lc)
 	if err != nil {
 		return err
 	}
+
 	cm.mu.Lock()
-	cm.listener = l
-	cm.mu.Unlock()
+	defer cm.mu.Unlock()
+	cm.specs = append(cm.specs, spec)
+	return nil
+}
+
+func (cm *ConnectionManager) Start() error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	specs := cm.specs
+	if len(specs) == 0 {
+		specs = []*listenerSpec{{kind: LISTENER_TCP, address: cm.hostname + ":" + strconv.Itoa(cm.port)}}
+	}
+	for _, spec := range specs {
+		l, err := spec.listen()
+		if err != nil {
+			cm.closeListeners()
+			return err
+		}
+		log.Printf("LISTENING: %s on %s\n", spec.kind, spec.address)
+		cm.listeners = append(cm.listeners, l)
+	}
 
 	// since the main loop will wait on new connections, we need to start a goroutine
 	// to handle any connections that notify us of a deletion request
@@ -64,36 +153,93 @@ func (cm *ConnectionManager) Start() error {
 
 	// this avoids tests being blocked
 	// not sure if it creates any problems for the actual software
-	go func() {
-		for {
-			conn, err := l.Accept() // loop will wait here until a new connection
-			if err != nil {
-				log.Fatal(err)
-			}
+	for i, l := range cm.listeners {
+		go cm.accept(l, specs[i], removeConnectionChan)
+	}
+	return nil
+}
 
-			thisUUID := uuid.NewString()
-			cm.mu.Lock()
-			cm.connections[thisUUID] = NewConnection(conn, thisUUID)
-			go cm.connections[thisUUID].Read(cm.messages, removeConnectionChan, cm.timeout)
-			cm.mu.Unlock()
+func (cm *ConnectionManager) accept(l net.Listener, spec *listenerSpec, removeConnectionChan chan string) {
+	for {
+		conn, err := l.Accept() // loop will wait here until a new connection
+		if errors.Is(err, net.ErrClosed) {
+			// Stop closed the listener
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-			log.Printf("NEW_CONNECTION: ID %s from remote address %s\n", thisUUID, conn.RemoteAddr().String())
+		go cm.serve(conn, spec, removeConnectionChan)
+	}
+}
 
+// serve completes the TLS handshake on a new connection, if it has one,
+// then registers the connection and reads from it until it closes
+func (cm *ConnectionManager) serve(conn net.Conn, spec *listenerSpec, removeConnectionChan chan string) {
+	peer := ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		if err != nil {
+			log.Printf("HANDSHAKE_FAILED: from remote address %s: %v\n", conn.RemoteAddr().String(), err)
+			conn.Close()
 			cm.messages <- CnxMgrMsg{
-				Type: NEW_CONNECTION,
-				ID:   thisUUID,
-				Msg:  thisUUID,
+				Type: HANDSHAKE_FAILED,
+				Msg:  conn.RemoteAddr().String(),
+				Err:  err,
 			}
+			return
 		}
-	}()
-	return nil
+		tlsConn.SetDeadline(time.Time{})
+
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			// the handshake has verified the certificate against the client CAs
+			peer = certPrincipal(certs[0], spec.certField)
+		}
+	}
+
+	thisUUID := uuid.NewString()
+	cm.mu.Lock()
+	connection := NewConnection(conn, thisUUID, cm.outbound)
+	connection.peer = peer
+	connection.maxBodySize = cm.maxBodySize
+	connection.drained = cm.drained
+	cm.connections[thisUUID] = connection
+	cm.mu.Unlock()
+
+	log.Printf("NEW_CONNECTION: ID %s from remote address %s\n", thisUUID, conn.RemoteAddr().String())
+
+	// announce the connection before reading from it so the engine
+	// always sees NEW_CONNECTION ahead of the connection's first frame
+	cm.messages <- CnxMgrMsg{
+		Type: NEW_CONNECTION,
+		ID:   thisUUID,
+		Msg:  thisUUID,
+	}
+	connection.Read(cm.messages, removeConnectionChan, cm.timeout)
 }
 
 func (cm *ConnectionManager) Stop() error {
-	return cm.listener.Close()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.closeListeners()
 }
 
-func (cm *ConnectionManager) Write(id string, msg string) error {
+// closeListeners closes every listener, returning the first error; cm.mu must be held
+func (cm *ConnectionManager) closeListeners() error {
+	var firstErr error
+	for _, l := range cm.listeners {
+		err := l.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	cm.listeners = nil
+	return firstErr
+}
+
+func (cm *ConnectionManager) Write(id string, msg []byte) error {
 	cm.mu.RLock()
 	connection, prs := cm.connections[id]
 	cm.mu.RUnlock()
@@ -105,9 +251,29 @@ func (cm *ConnectionManager) Write(id string, msg string) error {
 	return connection.Write(msg)
 }
 
+// WriteMessage queues a MESSAGE frame, which unlike other frames is subject to the slow consumer policy
+// unless reserved says room was claimed for it with Reserve. If the drop-oldest policy later discards
+// it unsent, dropped is called.
+func (cm *ConnectionManager) WriteMessage(id string, msg []byte, reserved bool, dropped func()) error {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	if !prs {
+		return fmt.Errorf("Connection %v no longer open", id)
+	}
+
+	return connection.WriteMessage(msg, reserved, dropped)
+}
+
 func (cm *ConnectionManager) handleRemovals(requests chan string) {
 	for id := range requests {
 		cm.mu.Lock()
+		if c, prs := cm.connections[id]; prs {
+			// keep the closed connection's slow consumer counts in the totals
+			atomic.AddUint64(&cm.dropped, atomic.LoadUint64(&c.dropped))
+			atomic.AddUint64(&cm.slow, uint64(atomic.LoadUint32(&c.slow)))
+		}
 		delete(cm.connections, id)
 		cm.mu.Unlock()
 
@@ -121,6 +287,124 @@ func (cm *ConnectionManager) handleRemovals(requests chan string) {
 	}
 }
 
+// Close closes a connection once the frames already written to it have been sent, e.g. after an ERROR frame
+func (cm *ConnectionManager) Close(id string) error {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	if !prs {
+		return fmt.Errorf("no such connection: %s", id)
+	}
+	connection.Close()
+	return nil
+}
+
+// SetVersion records the STOMP protocol version negotiated on a connection
+func (cm *ConnectionManager) SetVersion(id string, version string) error {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	if !prs {
+		return fmt.Errorf("no such connection: %s", id)
+	}
+	connection.SetVersion(version)
+	return nil
+}
+
+// Version returns the STOMP protocol version negotiated on a connection,
+// or an empty string if the connection does not exist or has not negotiated yet
+func (cm *ConnectionManager) Version(id string) string {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	if !prs {
+		return ""
+	}
+	return connection.Version()
+}
+
+// Open reports whether a connection is registered and can still be written to. A connection that
+// has failed stays registered until its CONNECTION_CLOSED event is handled, but is not open.
+func (cm *ConnectionManager) Open(id string) bool {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	return prs && connection.Open()
+}
+
+// HasRoom reports whether a connection is open and can queue another MESSAGE frame
+// without its slow consumer policy coming into play
+func (cm *ConnectionManager) HasRoom(id string) bool {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	return prs && connection.HasRoom()
+}
+
+// Reserve claims room in a connection's MESSAGE queue for a message that is yet to be written,
+// reporting false if the connection is closed or has no room
+func (cm *ConnectionManager) Reserve(id string) bool {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	return prs && connection.Reserve()
+}
+
+// Peer returns the name a connection's verified client certificate authenticates it as,
+// or an empty string if it presented none
+func (cm *ConnectionManager) Peer(id string) string {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	if !prs {
+		return ""
+	}
+	return connection.peer
+}
+
+// SetHeartbeat applies the heart-beat intervals negotiated on a connection
+func (cm *ConnectionManager) SetHeartbeat(id string, outgoing, incoming time.Duration) error {
+	cm.mu.RLock()
+	connection, prs := cm.connections[id]
+	cm.mu.RUnlock()
+
+	if !prs {
+		return fmt.Errorf("no such connection: %s", id)
+	}
+	connection.SetHeartbeat(outgoing, incoming)
+	return nil
+}
+
+// WaitFlushed waits until every connection that is closing has sent its queued frames, or ctx is done
+func (cm *ConnectionManager) WaitFlushed(ctx context.Context) {
+	cm.mu.RLock()
+	connections := make([]*Connection, 0, len(cm.connections))
+	for _, c := range cm.connections {
+		connections = append(connections, c)
+	}
+	cm.mu.RUnlock()
+
+	for _, c := range connections {
+		select {
+		case <-c.flush:
+		default:
+			continue
+		}
+		select {
+		case <-c.written:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (cm *ConnectionManager) Disconnect(id string) error {
 	cm.mu.RLock()
 	connection, prs := cm.connections[id]
@@ -128,59 +412,441 @@ func (cm *ConnectionManager) Disconnect(id string) error {
 	cm.mu.RUnlock()
 
 	if prs {
-		connection.Disconnect(to)
+		// closing waits out the timeout, so don't hold up the caller
+		go connection.Disconnect(to)
 	} else {
 		return fmt.Errorf("no such connection: %s", id)
 	}
 	return nil
 }
 
+// policies for a connection whose outbound queue is full. They only apply to MESSAGE frames:
+// other frames are written by the engine's main loop, which must not wait on one client, so they
+// are queued regardless, and a client that lets QueueSize of them pile up as well is closed as a
+// slow consumer under any policy.
+const (
+	SLOW_CONSUMER_DROP_OLDEST = "drop-oldest" // discard the oldest queued MESSAGE frame to make room
+	SLOW_CONSUMER_BLOCK       = "block"       // wait for room, holding up the writer
+	SLOW_CONSUMER_DISCONNECT  = "disconnect"  // close the connection
+)
+
+var errSlowConsumer = errors.New("slow consumer: outbound queue full")
+
+// OutboundConfig sets how much each connection may buffer for a slow reader and what happens when it is full
+type OutboundConfig struct {
+	QueueSize    int           // MESSAGE frames buffered per connection, and as many other frames
+	WriteTimeout time.Duration // how long one write may take before the connection is closed; 0 waits forever
+	Policy       string
+}
+
+var DefaultOutboundConfig = OutboundConfig{
+	QueueSize:    1024,
+	WriteTimeout: 10 * time.Second,
+	Policy:       SLOW_CONSUMER_DISCONNECT,
+}
+
+func (oc OutboundConfig) validate() error {
+	if oc.QueueSize < 1 {
+		return fmt.Errorf("outbound queue size must be at least 1, got %d", oc.QueueSize)
+	}
+	switch oc.Policy {
+	case SLOW_CONSUMER_DROP_OLDEST, SLOW_CONSUMER_BLOCK, SLOW_CONSUMER_DISCONNECT:
+		return nil
+	}
+	return fmt.Errorf("unknown slow consumer policy %s, expected drop-oldest, block or disconnect", oc.Policy)
+}
+
+// OutboundStats summarizes the outbound queues of every open connection
+type OutboundStats struct {
+	Queued       int    // frames waiting across all connections
+	MaxDepth     int    // frames waiting on the most backed up connection
+	Dropped      uint64 // MESSAGE frames discarded by the drop-oldest policy
+	Disconnected uint64 // connections closed as slow consumers
+}
+
 // Connection
+// Frames written to a connection are queued, and one writer goroutine per connection sends them
+// and its heart-beats, so a slow reader holds up nobody but itself.
 type Connection struct {
-	id   string
-	conn net.Conn
+	id          string
+	conn        net.Conn
+	version     string
+	peer        string        // from the client certificate; set before the connection is shared
+	maxBodySize int           // set before the connection is shared
+	readWindow  time.Duration // how long the peer may stay silent before it is considered dead
+	outbound    OutboundConfig
+	out         []outFrame // guarded by outMu
+	messages    int        // MESSAGE frames in out
+	reserved    int        // room in out claimed by Reserve
+	outMu       sync.Mutex
+	ready       chan struct{}      // signals the writer that out is not empty
+	room        chan struct{}      // signals writers blocked on a full queue that the writer took a frame
+	drained     chan struct{}      // the ConnectionManager's Notify channel; set before the connection is shared
+	heartbeat   chan time.Duration // hands the outgoing heart-beat interval to the writer
+	dropped     uint64             // accessed atomically
+	slow        uint32             // 1 once closed as a slow consumer, accessed atomically
+	closed      chan struct{}      // closed when Read returns
+	flush       chan struct{}      // closed by Close: the writer sends what is queued and closes the connection
+	flushOnce   sync.Once
+	written     chan struct{} // closed when the writer returns
+	mu          sync.RWMutex
 }
 
-func NewConnection(conn net.Conn, id string) *Connection {
-	return &Connection{
-		conn: conn,
-		id:   id,
+func NewConnection(conn net.Conn, id string, outbound OutboundConfig) *Connection {
+	c := &Connection{
+		conn:        conn,
+		id:          id,
+		maxBodySize: DefaultMaxBodySize,
+		outbound:    outbound,
+		ready:       make(chan struct{}, 1),
+		room:        make(chan struct{}, 1),
+		heartbeat:   make(chan time.Duration, 1),
+		closed:      make(chan struct{}),
+		flush:       make(chan struct{}),
+		written:     make(chan struct{}),
 	}
+	go c.writeLoop()
+	return c
 }
 
+// Read parses frames from the connection until it closes and forwards them to the engine.
+// A frame that cannot be parsed is forwarded as an error; since the stream can no longer be
+// trusted after that, the rest of the input is discarded until the engine closes the connection.
 func (c *Connection) Read(readTo chan CnxMgrMsg, done chan string, timeout time.Duration) {
-	scanner := bufio.NewScanner(c.conn)
-	scanner.Split(ScanNullTerm)
+	if timeout > 0 {
+		c.setReadWindow(timeout + 500*time.Millisecond)
+	}
+
+	fr := NewFrameReader(c.conn)
+	fr.SetMaxBodySize(c.maxBodySize)
 	for {
-		if ok := scanner.Scan(); !ok {
+		hb, err := fr.ReadHeartbeat()
+		if err != nil {
 			break
 		}
-		txt := scanner.Text()
-		if txt != "\n" {
-			// if it's not just a heartbeat EOL, send the frame
+		if !hb {
+			frame, err := fr.ReadFrame(c.Version())
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				readTo <- CnxMgrMsg{
+					Type: FRAME,
+					ID:   c.id,
+					Err:  err,
+				}
+				io.Copy(io.Discard, c.conn)
+				break
+			}
 			readTo <- CnxMgrMsg{
-				Type: FRAME,
-				ID:   c.id,
-				Msg:  (txt + "\000"), // have to append the null byte that the scanner strips
+				Type:  FRAME,
+				ID:    c.id,
+				Frame: frame,
 			}
 		}
-		if timeout > 0 {
-			c.conn.SetReadDeadline(time.Now().Add(timeout).Add(500 * time.Millisecond))
+		// any traffic, heartbeat or frame, shows the peer is alive
+		if window := c.ReadWindow(); window > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(window))
 		}
 	}
+	c.conn.Close()
+	close(c.closed)
 	done <- c.id
 }
 
-func (c *Connection) Write(msg string) error {
-	_, err := c.conn.Write([]byte(msg))
-	return err
+func (c *Connection) setReadWindow(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readWindow = window
+}
+
+func (c *Connection) ReadWindow() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.readWindow
+}
+
+// SetHeartbeat applies negotiated heart-beat intervals: the server sends an EOL whenever it has
+// written nothing for outgoing, and the peer is considered dead after it has been silent for
+// incoming plus a grace period of half that again. Zero disables either direction.
+func (c *Connection) SetHeartbeat(outgoing, incoming time.Duration) {
+	if incoming > 0 {
+		window := incoming + incoming/2
+		c.setReadWindow(window)
+		c.conn.SetReadDeadline(time.Now().Add(window))
+	} else {
+		c.setReadWindow(0)
+		c.conn.SetReadDeadline(time.Time{})
+	}
+
+	// replace any interval the writer has not picked up yet
+	select {
+	case <-c.heartbeat:
+	default:
+	}
+	c.heartbeat <- outgoing
+}
+
+// writeLoop sends queued frames, and an EOL whenever nothing has been sent for the heart-beat interval.
+// A write that fails or times out closes the connection.
+func (c *Connection) writeLoop() {
+	defer close(c.written)
+
+	var interval time.Duration
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case <-c.ready:
+			for msg, ok := c.next(); ok; msg, ok = c.next() {
+				if !c.send(msg) {
+					return
+				}
+				lastWrite = time.Now()
+			}
+		case interval = <-c.heartbeat:
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+			if interval > 0 {
+				// ticking at half the interval means an EOL always goes out before the interval is up
+				ticker = time.NewTicker(interval / 2)
+				tick = ticker.C
+			}
+		case now := <-tick:
+			if now.Sub(lastWrite) < interval/2 {
+				continue
+			}
+			if !c.send([]byte("\n")) {
+				return
+			}
+			lastWrite = now
+		case <-c.flush:
+			// send what was queued before Close, then close
+			for msg, ok := c.next(); ok; msg, ok = c.next() {
+				if !c.send(msg) {
+					return
+				}
+			}
+			c.conn.Close()
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// send writes one frame within the write timeout, closing the connection and returning false if it fails
+func (c *Connection) send(msg []byte) bool {
+	if c.outbound.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.outbound.WriteTimeout))
+	}
+	_, err := c.conn.Write(msg)
+	if err != nil {
+		log.Printf("WRITE_ERROR: client %s: %v\n", c.id, err)
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+func (c *Connection) SetVersion(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version = version
+}
+
+func (c *Connection) Version() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+// outFrame is a frame waiting in a connection's outbound queue
+type outFrame struct {
+	msg     []byte
+	message bool   // a MESSAGE frame, which the slow consumer policy applies to
+	dropped func() // called if the drop-oldest policy discards the frame; may be nil
+}
+
+// Write queues a frame other than MESSAGE to be sent by the connection's writer. It never waits:
+// if the client already has QueueSize such frames queued, it is closed as a slow consumer.
+func (c *Connection) Write(msg []byte) error {
+	if !c.Open() {
+		return net.ErrClosed
+	}
+	c.outMu.Lock()
+	if len(c.out)-c.messages >= c.outbound.QueueSize {
+		c.outMu.Unlock()
+		return c.disconnectSlow()
+	}
+	c.out = append(c.out, outFrame{msg: msg})
+	c.outMu.Unlock()
+	signalAvailable(c.ready)
+	return nil
+}
+
+// WriteMessage queues a MESSAGE frame to be sent by the connection's writer. Unless reserved says
+// room was claimed for it with Reserve, the connection's slow consumer policy decides what happens
+// if QueueSize MESSAGE frames are already queued; if it discards a queued frame, that frame's
+// dropped function is called.
+func (c *Connection) WriteMessage(msg []byte, reserved bool, dropped func()) error {
+	for {
+		if !c.Open() {
+			return net.ErrClosed
+		}
+		c.outMu.Lock()
+		if reserved || !c.full() {
+			if reserved {
+				c.reserved--
+			}
+			c.out = append(c.out, outFrame{msg: msg, message: true, dropped: dropped})
+			c.messages++
+			c.outMu.Unlock()
+			signalAvailable(c.ready)
+			return nil
+		}
+
+		switch c.outbound.Policy {
+		case SLOW_CONSUMER_DROP_OLDEST:
+			oldest := -1
+			for i := range c.out {
+				if c.out[i].message {
+					oldest = i
+					break
+				}
+			}
+			if oldest < 0 {
+				// the room is all reserved for messages yet to be written, so there is nothing to drop
+				c.out = append(c.out, outFrame{msg: msg, message: true, dropped: dropped})
+				c.messages++
+				c.outMu.Unlock()
+				signalAvailable(c.ready)
+				return nil
+			}
+			old := c.out[oldest]
+			c.out = append(append(c.out[:oldest:oldest], c.out[oldest+1:]...), outFrame{msg: msg, message: true, dropped: dropped})
+			c.outMu.Unlock()
+			atomic.AddUint64(&c.dropped, 1)
+			if old.dropped != nil {
+				old.dropped()
+			}
+			return nil
+		case SLOW_CONSUMER_BLOCK:
+			c.outMu.Unlock()
+			// the write timeout bounds the wait: a reader that stops reading gets closed
+			select {
+			case <-c.room:
+			case <-c.closed:
+			case <-c.flush:
+			case <-c.written:
+			}
+		default:
+			c.outMu.Unlock()
+			return c.disconnectSlow()
+		}
+	}
+}
+
+// disconnectSlow closes a client that is not keeping up with its outbound queue
+func (c *Connection) disconnectSlow() error {
+	if atomic.CompareAndSwapUint32(&c.slow, 0, 1) {
+		log.Printf("SLOW_CONSUMER: client %s: closing with %d frames queued\n", c.id, c.depth())
+	}
+	c.conn.Close()
+	return errSlowConsumer
+}
+
+// next takes the oldest frame from the outbound queue, reporting false if it is empty
+func (c *Connection) next() ([]byte, bool) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if len(c.out) == 0 {
+		return nil, false
+	}
+	f := c.out[0]
+	c.out[0] = outFrame{}
+	c.out = c.out[1:]
+	if f.message {
+		if c.full() {
+			signalAvailable(c.drained)
+		}
+		c.messages--
+		signalAvailable(c.room)
+	}
+	return f.msg, true
+}
+
+// HasRoom reports whether the connection is open and can queue another MESSAGE frame
+// without its slow consumer policy coming into play
+func (c *Connection) HasRoom() bool {
+	if !c.Open() {
+		return false
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return !c.full()
+}
+
+// Reserve claims room for one MESSAGE frame, which must then be written with reserved set
+func (c *Connection) Reserve() bool {
+	if !c.Open() {
+		return false
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.full() {
+		return false
+	}
+	c.reserved++
+	return true
+}
+
+// full assumes c.outMu is held
+func (c *Connection) full() bool {
+	return c.messages+c.reserved >= c.outbound.QueueSize
 }
 
-func (c *Connection) Disconnect(timeout time.Duration) error {
+// depth is the number of frames in the outbound queue
+func (c *Connection) depth() int {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return len(c.out)
+}
+
+// Open reports whether frames written to the connection can still be sent
+func (c *Connection) Open() bool {
+	select {
+	case <-c.closed:
+	case <-c.flush:
+	case <-c.written:
+	default:
+		return true
+	}
+	return false
+}
+
+// Close sends whatever is already queued, then closes the connection. It does not wait for either.
+func (c *Connection) Close() {
+	c.flushOnce.Do(func() { close(c.flush) })
+}
+
+func (c *Connection) Disconnect(timeout time.Duration) {
 	// if a connection asks to disconnect, wait timeout seconds and close the connection
 	log.Printf("DISCONNECT from client ID %s\n", c.id)
 	time.Sleep(timeout)
-	return c.conn.Close()
+	c.Close()
 }
 
 // CnxMgrMsg
@@ -189,35 +855,15 @@ const (
 	NEW_CONNECTION = iota
 	CONNECTION_CLOSED
 	FRAME
+	HANDSHAKE_FAILED
 )
 
+// FRAME messages carry either a parsed Frame or the Err that stopped it from parsing
+// HANDSHAKE_FAILED messages carry the remote address in Msg and have no ID, since no connection was made
 type CnxMgrMsg struct {
-	Type int
-	ID   string
-	Msg  string
-}
-
-// Custom scanner to split incoming stream on \000
-func ScanNullTerm(data []byte, atEOF bool) (int, []byte, error) {
-	// if we're at EOF, we're done for now
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-
-	// if we find a '\000', return the data up to and including that index
-	if i := bytes.IndexByte(data, '\000'); i >= 0 {
-		// there is a null-terminated frame
-		return i + 1, data[0:i], nil
-	}
-
-	// if we did not find a null-terminated frame, still need to check for \n
-	if len(data) > 0 && data[0] == '\n' {
-		return 1, []byte{data[0]}, nil
-	}
-
-	// if we are at EOF and we have data, return it so we can see what's going on
-	if atEOF {
-		return len(data), data, nil
-	}
-	return 0, nil, nil
+	Type  int
+	ID    string
+	Msg   string
+	Frame Frame
+	Err   error
 }
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"io"
 	"net"
-	"reflect"
-	"strings"
 	"testing"
+	"time"
 )
 
 func TestConnectionManager(t *testing.T) {
@@ -32,6 +30,36 @@ func TestConnectionManager(t *testing.T) {
 		message = <-messages
 	})
 
+	t.Run("_ReadFrame", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ":32801")
+		if err != nil {
+			t.Error("could not connect to server: ", err)
+		}
+		<-messages
+
+		_, err = conn.Write([]byte("\nSEND\ndestination:/queue/a\ncontent-length:3\n\na\000b\000"))
+		if err != nil {
+			t.Error("write error: ", err)
+		}
+		msg := <-messages
+		if msg.Type != FRAME || msg.Err != nil {
+			t.Errorf("did not receive parsed frame: type %d error %v", msg.Type, msg.Err)
+		} else if msg.Frame.Command != SEND || string(msg.Frame.Body) != "a\000b" {
+			t.Errorf("frame parsed incorrectly: %+v", msg.Frame)
+		}
+
+		_, err = conn.Write([]byte("BOOGIE\n\n\000"))
+		if err != nil {
+			t.Error("write error: ", err)
+		}
+		msg = <-messages
+		if msg.Type != FRAME || msg.Err == nil {
+			t.Errorf("did not receive parse error: type %d error %v", msg.Type, msg.Err)
+		}
+		conn.Close()
+		msg = <-messages
+	})
+
 	t.Run("_Write", func(t *testing.T) {
 		conn, err := net.Dial("tcp", ":32801")
 		if err != nil {
@@ -44,7 +72,7 @@ func TestConnectionManager(t *testing.T) {
 		}
 
 		id := msg.Msg
-		err = cm.Write(id, "Test\n")
+		err = cm.Write(id, []byte("Test\n"))
 		if err != nil {
 			t.Error("write error: ", err)
 		}
@@ -62,6 +90,54 @@ func TestConnectionManager(t *testing.T) {
 		msg = <-messages
 	})
 
+	t.Run("_HeartbeatSend", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ":32801")
+		if err != nil {
+			t.Error("could not connect to server: ", err)
+		}
+		msg := <-messages
+
+		err = cm.SetHeartbeat(msg.ID, 50*time.Millisecond, 0)
+		if err != nil {
+			t.Error("heartbeat error: ", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 1)
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			t.Error("no heartbeat received: ", err)
+		} else if b[0] != '\n' {
+			t.Errorf("got %q wanted heartbeat EOL", b)
+		}
+		conn.Close()
+		msg = <-messages
+	})
+
+	t.Run("_HeartbeatDeadPeer", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ":32801")
+		if err != nil {
+			t.Error("could not connect to server: ", err)
+		}
+		defer conn.Close()
+		msg := <-messages
+
+		err = cm.SetHeartbeat(msg.ID, 0, 50*time.Millisecond)
+		if err != nil {
+			t.Error("heartbeat error: ", err)
+		}
+
+		// a peer that stays silent past the grace window gets reaped
+		select {
+		case msg = <-messages:
+			if msg.Type != CONNECTION_CLOSED {
+				t.Error("connection failed to close or another message sent")
+			}
+		case <-time.After(time.Second):
+			t.Error("silent peer was not disconnected")
+		}
+	})
+
 	t.Run("_handleRemovals", func(t *testing.T) {
 		conn, err := net.Dial("tcp", ":32801")
 		if err != nil {
@@ -96,63 +172,124 @@ func TestConnectionManager(t *testing.T) {
 	})
 }
 
-func TestScanNullTerm(t *testing.T) {
-	empty := []byte("")
-	nullTerm := []byte("Null-term\000")
-	multipleNull := []byte("Null-term\000another\000")
-	noNull := []byte("Justwords\n")
-	var tests = []struct {
-		input []byte
-		eof   bool
-		adv   int
-		token []byte
-		err   error
-	}{
-		{empty, false, 0, nil, nil},
-		{nullTerm, false, 10, nullTerm[:len(nullTerm)-1], nil},
-		{multipleNull, false, 10, nullTerm[:len(nullTerm)-1], nil},
-		{noNull, false, 0, nil, nil},
-		{noNull, true, 10, noNull, nil},
+// queueBehindWriter returns a connection whose writer is stuck sending "1" to a peer that isn't reading
+func queueBehindWriter(t *testing.T, oc OutboundConfig) (*Connection, net.Conn) {
+	server, client := net.Pipe()
+	c := NewConnection(server, "slow", oc)
+	err := c.WriteMessage([]byte("1"), false, nil)
+	if err != nil {
+		t.Fatal("write error: ", err)
 	}
-
-	for _, tt := range tests {
-		testname := string(tt.input)
-		t.Run(testname, func(t *testing.T) {
-			advance, token, err := ScanNullTerm(tt.input, tt.eof)
-			if err != tt.err {
-				t.Errorf("err val: got %v wanted %v\n", err, tt.err)
-			} else if advance != tt.adv {
-				t.Errorf("wrong adv val: got %d wanted %d\n", advance, tt.adv)
-			} else if !reflect.DeepEqual(token, tt.token) {
-				t.Errorf("wrong token val: got %s wanted %s\n", string(token), string(tt.token))
-			}
-		})
+	for c.depth() > 0 {
+		time.Sleep(time.Millisecond)
 	}
+	return c, client
 }
 
-func TestScannerNullTerm(t *testing.T) {
-	nullTerm := "Null-term\000"
-	multipleNull := "Null-term\000another\000"
-	var tests = []struct {
-		input  string
-		tokens []string
-	}{
-		{nullTerm, []string{"Null-term"}},
-		{multipleNull, []string{"Null-term", "another"}},
+func readN(t *testing.T, conn net.Conn, n int) string {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal("read error: ", err)
 	}
+	return string(buf)
+}
 
-	for _, tt := range tests {
-		testname := string(tt.input)
-		t.Run(testname, func(t *testing.T) {
-			scanner := bufio.NewScanner(strings.NewReader(tt.input))
-			scanner.Split(ScanNullTerm)
-			output := make([]string, 0)
-			for scanner.Scan() {
-				output = append(output, scanner.Text())
+func TestConnectionSlowConsumer(t *testing.T) {
+	t.Run("_DropOldest", func(t *testing.T) {
+		c, client := queueBehindWriter(t, OutboundConfig{QueueSize: 2, Policy: SLOW_CONSUMER_DROP_OLDEST})
+		defer client.Close()
+		var dropped []string
+		for _, msg := range []string{"R", "2", "3", "4", "5"} {
+			var err error
+			if msg == "R" {
+				// a RECEIPT ahead of the messages is never the one dropped
+				err = c.Write([]byte(msg))
+			} else {
+				msg := msg
+				err = c.WriteMessage([]byte(msg), false, func() { dropped = append(dropped, msg) })
 			}
-			if !reflect.DeepEqual(output, tt.tokens) {
-				t.Errorf("output: %v wanted %v\n", output, tt.tokens)
+			if err != nil {
+				t.Fatal("write error: ", err)
 			}
-		})
-	}
+		}
+		if got := readN(t, client, 4); got != "1R45" {
+			t.Errorf("got %q wanted 1R45", got)
+		}
+		if c.dropped != 2 {
+			t.Errorf("got %d dropped wanted 2", c.dropped)
+		}
+		if len(dropped) != 2 || dropped[0] != "2" || dropped[1] != "3" {
+			t.Errorf("got %v handed back wanted [2 3]", dropped)
+		}
+	})
+
+	t.Run("_Block", func(t *testing.T) {
+		c, client := queueBehindWriter(t, OutboundConfig{QueueSize: 1, Policy: SLOW_CONSUMER_BLOCK})
+		defer client.Close()
+		err := c.WriteMessage([]byte("2"), false, nil)
+		if err != nil {
+			t.Fatal("write error: ", err)
+		}
+		// other frames come from the engine's main loop, which must not wait
+		start := time.Now()
+		err = c.Write([]byte("R"))
+		if err != nil {
+			t.Fatal("write error: ", err)
+		}
+		if time.Since(start) > 40*time.Millisecond {
+			t.Error("write of a RECEIPT waited for the queue to have room")
+		}
+
+		got := make(chan string)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			got <- readN(t, client, 4)
+		}()
+		start = time.Now()
+		err = c.WriteMessage([]byte("3"), false, nil)
+		if err != nil {
+			t.Fatal("write error: ", err)
+		}
+		if time.Since(start) < 40*time.Millisecond {
+			t.Error("write returned before the queue had room")
+		}
+		if s := <-got; s != "12R3" {
+			t.Errorf("got %q wanted 12R3", s)
+		}
+	})
+
+	t.Run("_Disconnect", func(t *testing.T) {
+		c, client := queueBehindWriter(t, OutboundConfig{QueueSize: 1, Policy: SLOW_CONSUMER_DISCONNECT})
+		defer client.Close()
+		err := c.WriteMessage([]byte("2"), false, nil)
+		if err != nil {
+			t.Fatal("write error: ", err)
+		}
+		err = c.WriteMessage([]byte("3"), false, nil)
+		if err != errSlowConsumer {
+			t.Errorf("got error %v wanted %v", err, errSlowConsumer)
+		}
+		if c.slow != 1 {
+			t.Error("connection not counted as a slow consumer")
+		}
+		_, err = client.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("expected the connection to be closed, got %v", err)
+		}
+	})
+
+	t.Run("_WriteTimeout", func(t *testing.T) {
+		c, client := queueBehindWriter(t, OutboundConfig{QueueSize: 1, WriteTimeout: 20 * time.Millisecond, Policy: SLOW_CONSUMER_BLOCK})
+		defer client.Close()
+		select {
+		case <-c.written:
+		case <-time.After(time.Second):
+			t.Fatal("writer still running after its write timed out")
+		}
+		_, err := client.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("expected the connection to be closed, got %v", err)
+		}
+	})
 }
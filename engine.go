@@ -1,38 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type Engine struct {
 	CM            *ConnectionManager
 	SM            *SubscriptionManager
 	TM            *TransactionManager
+	AM            *AckManager
+	Auth          Authenticator
+	ACL           *ACL // nil allows every operation
 	MS            *MetricsService
 	metricsServer bool
 	msAddr        string
+	heartbeat     time.Duration
 	Incoming      chan CnxMgrMsg
+	sessions      map[string]*Session
 	Store         Store
 	SendWorkers   int
+	stop          chan time.Duration // carries the shutdown timeout
+	stopDispatch  chan struct{}
+	dispatchDone  chan struct{}
+	authDone      chan authResult // CONNECT frames authenticated off the main loop
+	authSlots     chan struct{}   // bounds how many clients are authenticated at once
 }
 
-func NewEngine(st Store, cm *ConnectionManager, inc chan CnxMgrMsg, sendWorkers int, metricsServer bool, msAddr string) *Engine {
+// maxConcurrentAuth is how many CONNECT frames are authenticated at once. Checking a bcrypt
+// hash keeps a CPU busy, so a flood of CONNECT frames only ever takes this many.
+const maxConcurrentAuth = 4
+
+// maxHeldFrames is how many frames a client may send after CONNECT before it gets CONNECTED
+const maxHeldFrames = 64
+
+var errShuttingDown = errors.New("server shutting down")
+
+func NewEngine(st Store, cm *ConnectionManager, inc chan CnxMgrMsg, sendWorkers int, metricsServer bool, msAddr string, heartbeat time.Duration) *Engine {
+	ms := NewMetricsService()
+	ms.SetOutboundStats(cm.OutboundStats)
 	return &Engine{
 		CM:            cm,
 		Store:         st,
 		Incoming:      inc,
+		sessions:      make(map[string]*Session),
 		SM:            NewSubscriptionManager(),
 		TM:            NewTransactionManager(),
+		AM:            NewAckManager(),
+		Auth:          AnonymousAuthenticator{},
 		SendWorkers:   sendWorkers,
-		MS:            NewMetricsService(),
+		MS:            ms,
 		metricsServer: metricsServer,
 		msAddr:        msAddr,
+		heartbeat:     heartbeat,
+		stop:          make(chan time.Duration, 1),
+		stopDispatch:  make(chan struct{}),
+		dispatchDone:  make(chan struct{}),
+		authDone:      make(chan authResult),
+		authSlots:     make(chan struct{}, maxConcurrentAuth),
 	}
 }
 
 func (e *Engine) Start() error {
+	if e.SendWorkers < 1 {
+		return fmt.Errorf("need at least 1 send worker, got %d", e.SendWorkers)
+	}
+
 	err := e.CM.Start()
 	if err != nil {
 		return err
@@ -46,127 +89,334 @@ func (e *Engine) Start() error {
 		go e.MS.ListenAndServeJSON(e.msAddr)
 	}
 
+	// transactions are checked for timeouts when they are used, and swept this often
+	// so that ones a client has abandoned don't live forever
+	var expire <-chan time.Time
+	if e.TM.timeout > 0 {
+		ticker := time.NewTicker(e.TM.timeout)
+		defer ticker.Stop()
+		expire = ticker.C
+	}
+
 	log.Println("Entering main loop")
-	for msg := range e.Incoming {
+	for {
+		var msg CnxMgrMsg
+		select {
+		case msg = <-e.Incoming:
+		case <-expire:
+			e.TM.Expire()
+			continue
+		case r := <-e.authDone:
+			e.finishConnect(r)
+			continue
+		case timeout := <-e.stop:
+			return e.drain(timeout)
+		}
+
 		if msg.Type == FRAME {
-			frame, err := ParseFrame(msg.Msg)
-			if err != nil {
-				log.Printf("ERROR: client %s and error %s\n", msg.ID, err)
-				err2 := e.handleError(msg, err)
-				if err2 != nil {
-					log.Printf("ERROR: client %s write error: %s\n", msg.ID, err2)
-				}
-			} else {
-				e.MS.IncReceived()
-			}
-			switch frame.Command {
-			case CONNECT:
-			case STOMP:
-				response := e.handleConnect(msg)
-				err = e.CM.Write(msg.ID, response)
-				if err != nil {
-					log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-				}
-			case SUBSCRIBE:
-				err = e.handleSubscribe(msg, frame)
-				if err != nil {
-					log.Println(err)
-					err2 := e.handleError(msg, err)
-					if err2 != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err2)
-					}
-				} else {
-					err = e.handleReceipt(msg, frame)
-					if err != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-					}
-				}
-			case UNSUBSCRIBE:
-				err = e.handleUnsubscribe(msg, frame)
-				if err != nil {
-					log.Println(err)
-					err2 := e.handleError(msg, err)
-					if err2 != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err2)
-					}
-				} else {
-					err = e.handleReceipt(msg, frame)
-					if err != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-					}
-				}
-			case SEND:
-				err = e.handleSend(msg, frame)
-				if err != nil {
-					log.Println(err)
-					err2 := e.handleError(msg, err)
-					if err2 != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err2)
-					}
-				} else {
-					err = e.handleReceipt(msg, frame)
-					if err != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-					}
-				}
-			case DISCONNECT:
-				err = e.handleDisconnect(msg, frame)
-				if err != nil {
-					log.Println(err)
-				} else {
-					err = e.handleReceipt(msg, frame)
-					if err != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-					}
-				}
-			case BEGIN:
-				err = e.handleBegin(msg, frame)
-				if err != nil {
-					log.Println(err)
-					err := e.handleError(msg, err)
-					if err != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-					}
-				}
-			case ABORT:
-				err = e.handleAbort(msg, frame)
-				if err != nil {
-					log.Println(err)
-					err := e.handleError(msg, err)
-					if err != nil {
-						log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
-					}
-				}
-			case COMMIT:
-				err = e.handleCommit(msg, frame)
-				if err != nil {
-					err := fmt.Errorf("handleCommit: %v", err)
-					log.Println(err)
-					err = e.handleError(msg, err)
-					if err != nil {
-						log.Printf("handleError: client %s: %v\n", msg.ID, err)
-					}
-				}
+			if msg.Err != nil {
+				// the rest of the stream can't be framed reliably, so the connection has to go
+				log.Printf("ERROR: client %s and error %s\n", msg.ID, msg.Err)
+				e.rejectFrame(msg, msg.Err)
+				continue
 			}
+			e.MS.IncReceived()
+			e.handleFrame(msg)
+		} else if msg.Type == NEW_CONNECTION {
+			e.sessions[msg.ID] = NewSession(msg.ID)
+		} else if msg.Type == HANDSHAKE_FAILED {
+			e.MS.IncHandshakeFailed()
 		} else if msg.Type == CONNECTION_CLOSED {
+			delete(e.sessions, msg.ID)
+			e.TM.AbortAll(msg.ID)
 			e.SM.UnsubscribeAll(msg.ID)
+			e.redeliver(e.AM.RemoveClient(msg.ID))
+		}
+	}
+}
+
+// handleFrame handles a parsed frame from a client
+func (e *Engine) handleFrame(msg CnxMgrMsg) {
+	frame := msg.Frame
+
+	session, prs := e.sessions[msg.ID]
+	if !prs {
+		log.Printf("ERROR: frame from client %s with no session\n", msg.ID)
+		return
+	}
+	err := session.Allows(frame.Command)
+	if err != nil {
+		log.Printf("ERROR: client %s: %s\n", msg.ID, err)
+		e.rejectFrame(msg, err)
+		return
+	}
+	if session.State == SESSION_AUTHENTICATING {
+		// the client has not waited for CONNECTED; its frames are handled once it is connected
+		if len(session.held) >= maxHeldFrames {
+			e.rejectFrame(msg, fmt.Errorf("more than %d frames sent before CONNECTED", maxHeldFrames))
+			return
+		}
+		session.held = append(session.held, msg)
+		return
+	}
+
+	switch frame.Command {
+	case CONNECT, STOMP:
+		err = e.handleConnect(msg, frame)
+		if err != nil {
+			log.Println(err)
+		}
+	case SUBSCRIBE:
+		e.reply(msg, frame, e.handleSubscribe(msg, frame))
+	case UNSUBSCRIBE:
+		e.reply(msg, frame, e.handleUnsubscribe(msg, frame))
+	case SEND:
+		// handleSend returns once the store has accepted the message, so the receipt confirms it is stored
+		e.reply(msg, frame, e.handleSend(msg, frame))
+	case DISCONNECT:
+		// the receipt has to go out before the connection is closed
+		session.State = SESSION_DISCONNECTING
+		e.reply(msg, frame, nil)
+		err = e.handleDisconnect(msg, frame)
+		if err != nil {
+			log.Println(err)
+		}
+	case ACK:
+		e.reply(msg, frame, e.handleAck(msg, frame))
+	case NACK:
+		e.reply(msg, frame, e.handleNack(msg, frame))
+	case BEGIN:
+		e.reply(msg, frame, e.handleBegin(msg, frame))
+	case ABORT:
+		e.reply(msg, frame, e.handleAbort(msg, frame))
+	case COMMIT:
+		err = e.handleCommit(msg, frame)
+		if err != nil {
+			err = fmt.Errorf("handleCommit: %v", err)
+		}
+		e.reply(msg, frame, err)
+	}
+}
+
+// Shutdown asks a started engine to drain and return from Start, giving up on anything still pending after timeout
+func (e *Engine) Shutdown(timeout time.Duration) {
+	select {
+	case e.stop <- timeout:
+	default:
+		// already shutting down
+	}
+}
+
+// drain runs on the main loop once Shutdown is called. It stops accepting connections,
+// lets the send workers finish the messages they have already taken from the store,
+// sends connected clients an ERROR frame and closes them, puts their unacknowledged
+// messages back in the store, and finally closes the metrics server and the store.
+func (e *Engine) drain(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	log.Printf("SHUTDOWN: draining with timeout %v\n", timeout)
+
+	err := e.CM.Stop()
+	if err != nil {
+		log.Printf("SHUTDOWN: error closing listeners: %v\n", err)
+	}
+
+	close(e.stopDispatch)
+	if !e.dispatchStopped(ctx) {
+		log.Println("SHUTDOWN: timed out waiting for send workers")
+	}
+
+	for id, session := range e.sessions {
+		if session.State == SESSION_CONNECTED {
+			eFrame := UnmarshalFrameVersion(Frame{
+				Command: ERROR,
+				Headers: map[string]string{"message": errShuttingDown.Error()},
+				Body:    []byte{},
+			}, e.CM.Version(id))
+			err := e.CM.Write(id, eFrame)
+			if err != nil {
+				log.Printf("ERROR: client %s write error: %s\n", id, err)
+			}
 		}
+		e.CM.Close(id)
+		e.TM.AbortAll(id)
+		e.SM.UnsubscribeAll(id)
+		e.redeliver(e.AM.RemoveClient(id))
+		delete(e.sessions, id)
+	}
+	e.CM.WaitFlushed(ctx)
+
+	var firstErr error
+	if e.metricsServer {
+		firstErr = e.MS.Shutdown(ctx)
+	}
+	// send workers that are still running may yet requeue messages whose connections were just closed,
+	// so the store is left open rather than closed under them; it has synced everything it was given
+	if e.dispatchStopped(ctx) {
+		err = e.Store.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	} else {
+		log.Println("SHUTDOWN: send workers still running, leaving the store open")
+	}
+	log.Println("SHUTDOWN: complete")
+	return firstErr
+}
+
+// dispatchStopped waits for the dispatch loop and send workers to finish, reporting false if ctx is done first
+func (e *Engine) dispatchStopped(ctx context.Context) bool {
+	select {
+	case <-e.dispatchDone:
+		return true
+	default:
+	}
+	select {
+	case <-e.dispatchDone:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (e *Engine) handleConnect(msg CnxMgrMsg, frame Frame) error {
+	// e.handleConnect takes a CONNECT or STOMP frame and starts authenticating the client; finishConnect
+	// replies with a CONNECTED frame. If no protocol version or heart-beat can be agreed on, or the client
+	// fails to authenticate, the reply is an ERROR frame and the connection is closed
+	version, err := negotiateVersion(frame.Headers["accept-version"])
+	if err != nil {
+		e.refuseConnect(msg, err, map[string]string{"version": strings.Join(supportedVersions, ",")},
+			"Supported protocol versions are "+strings.Join(supportedVersions, " "))
+		return fmt.Errorf("error: client %s: %v", msg.ID, err)
 	}
+
+	outgoing, incoming, err := negotiateHeartbeat(frame.Headers["heart-beat"], e.heartbeat, e.CM.timeout)
+	if err != nil {
+		e.refuseConnect(msg, err, map[string]string{}, "heart-beat must be two comma separated, non-negative integers")
+		return fmt.Errorf("error: client %s: %v", msg.ID, err)
+	}
+
+	// checking a passcode is slow on purpose, so it runs off the main loop, a few at a time,
+	// and the result comes back through authDone
+	e.sessions[msg.ID].State = SESSION_AUTHENTICATING
+	go func() {
+		select {
+		case e.authSlots <- struct{}{}:
+		case <-e.stopDispatch:
+			return
+		}
+		principal, err := e.authenticate(msg, frame)
+		<-e.authSlots
+
+		select {
+		case e.authDone <- authResult{msg: msg, frame: frame, version: version, outgoing: outgoing, incoming: incoming, principal: principal, err: err}:
+		case <-e.stopDispatch:
+			// the engine is shutting down and no longer takes results
+		}
+	}()
 	return nil
 }
 
-func (e *Engine) handleConnect(msg CnxMgrMsg) string {
-	// e.handleConnect takes a CONNECT or STOMP frame and produces a CONNECTED frame
-	// TODO: handle protocol negotiation ERROR generation
-	heartbeatStr := "0"
-	if e.CM.timeout.Milliseconds() > 0 {
-		heartbeatStr = strconv.Itoa(int(e.CM.timeout.Milliseconds()))
+// authResult is the outcome of authenticating a CONNECT frame, with what was negotiated before it
+type authResult struct {
+	msg                CnxMgrMsg
+	frame              Frame
+	version            string
+	outgoing, incoming time.Duration
+	principal          Principal
+	err                error
+}
+
+// finishConnect answers a CONNECT frame once its client has been authenticated,
+// then handles any frames the client sent in the meantime
+func (e *Engine) finishConnect(r authResult) {
+	session, prs := e.sessions[r.msg.ID]
+	if !prs || session.State != SESSION_AUTHENTICATING {
+		// the connection closed while it was being authenticated
+		return
+	}
+	held := session.held
+	session.held = nil
+
+	err := e.connected(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, msg := range held {
+		e.handleFrame(msg)
+	}
+}
+
+// connected completes the CONNECT handshake once authentication has returned,
+// replying with a CONNECTED frame, or an ERROR frame if the client was not accepted
+func (e *Engine) connected(r authResult) error {
+	msg := r.msg
+	session := e.sessions[msg.ID]
+	if r.err != nil {
+		session.State = SESSION_AWAITING_CONNECT
+		log.Printf("AUTH_FAILED: client %s as login %q\n", msg.ID, r.frame.Headers["login"])
+		e.refuseConnect(msg, r.err, map[string]string{}, "The login and passcode supplied were not accepted")
+		return fmt.Errorf("error: client %s: %v", msg.ID, r.err)
+	}
+
+	err := e.CM.SetVersion(msg.ID, r.version)
+	if err != nil {
+		return err
+	}
+	err = e.CM.SetHeartbeat(msg.ID, r.outgoing, r.incoming)
+	if err != nil {
+		return err
 	}
-	return UnmarshalFrame(Frame{
+	session.State = SESSION_CONNECTED
+	session.Principal = r.principal
+	log.Printf("CONNECTED: client %s as %q with protocol version %s, heart-beat out %v in %v\n", msg.ID, r.principal.Name, r.version, r.outgoing, r.incoming)
+
+	return e.CM.Write(msg.ID, UnmarshalFrame(Frame{
 		Command: CONNECTED,
-		Headers: map[string]string{"version": "1.2", "host": e.CM.Hostname(), "heart-beat": "0," + heartbeatStr},
-		Body:    "",
+		Headers: map[string]string{
+			"version":    r.version,
+			"session":    msg.ID,
+			"host":       e.CM.Hostname(),
+			"heart-beat": strconv.FormatInt(e.heartbeat.Milliseconds(), 10) + "," + strconv.FormatInt(e.CM.timeout.Milliseconds(), 10),
+		},
+		Body: []byte{},
+	}))
+}
+
+// authenticate returns the principal a CONNECT frame's connection acts as.
+// A verified client certificate takes the place of a passcode, but a login naming anyone else is refused.
+func (e *Engine) authenticate(msg CnxMgrMsg, frame Frame) (Principal, error) {
+	peer := e.CM.Peer(msg.ID)
+	if peer == "" {
+		return e.Auth.Authenticate(frame.Headers["login"], frame.Headers["passcode"])
+	}
+
+	login, prs := frame.Headers["login"]
+	if prs && login != peer {
+		return Principal{}, errAuthFailed
+	}
+	return Principal{Name: peer}, nil
+}
+
+// refuseConnect answers a CONNECT frame that cannot be accepted with an ERROR frame and closes the connection
+func (e *Engine) refuseConnect(msg CnxMgrMsg, err error, headers map[string]string, body string) {
+	headers["content-type"] = "text/plain"
+	headers["message"] = err.Error()
+	eFrame := UnmarshalFrame(Frame{
+		Command: ERROR,
+		Headers: headers,
+		Body:    []byte(body),
 	})
+	e.MS.IncError()
+	err2 := e.CM.Write(msg.ID, eFrame)
+	if err2 != nil {
+		log.Printf("ERROR: client %s write error: %s\n", msg.ID, err2)
+	}
+	err2 = e.CM.Close(msg.ID)
+	if err2 != nil {
+		log.Printf("ERROR: client %s close error: %s\n", msg.ID, err2)
+	}
 }
 
 func (e *Engine) handleDisconnect(msg CnxMgrMsg, frame Frame) error {
@@ -187,6 +437,18 @@ func (e *Engine) handleSubscribe(msg CnxMgrMsg, frame Frame) error {
 	if !prs {
 		create = "false"
 	}
+	ackMode, prs := frame.Headers["ack"]
+	if !prs {
+		ackMode = ACK_AUTO
+	}
+	if !validateAckMode(ackMode) {
+		return fmt.Errorf("error: client %s: invalid ack mode %s on SUBSCRIBE frame", msg.ID, ackMode)
+	}
+
+	err := e.authorize(msg, dest, PERM_READ)
+	if err != nil {
+		return err
+	}
 
 	destPrs := e.Store.Prs(dest)
 	if create != "true" {
@@ -195,13 +457,17 @@ func (e *Engine) handleSubscribe(msg CnxMgrMsg, frame Frame) error {
 		}
 	} else {
 		if !destPrs {
-			err := e.Store.AddDestination(dest)
+			err := e.authorize(msg, dest, PERM_CREATE)
+			if err != nil {
+				return err
+			}
+			err = e.Store.AddDestination(dest)
 			if err != nil {
 				return err
 			}
 		}
 	}
-	return e.SM.Subscribe(clientID, subID, dest)
+	return e.SM.Subscribe(clientID, subID, dest, ackMode)
 }
 
 func (e *Engine) handleUnsubscribe(msg CnxMgrMsg, frame Frame) error {
@@ -212,27 +478,175 @@ func (e *Engine) handleUnsubscribe(msg CnxMgrMsg, frame Frame) error {
 		return fmt.Errorf("error: client %s: no ID on UNSUBSCRIBE frame", msg.ID)
 	}
 
-	return e.SM.Unsubscribe(clientID, subID)
+	err := e.SM.Unsubscribe(clientID, subID)
+	if err != nil {
+		return err
+	}
+
+	e.redeliver(e.AM.RemoveSubscription(clientID, subID))
+	return nil
+}
+
+func (e *Engine) handleAck(msg CnxMgrMsg, frame Frame) error {
+	subID, ackID, err := e.ackTarget(msg, frame)
+	if err != nil {
+		return err
+	}
+
+	// acknowledgements in a transaction are applied when it commits
+	if tx, prs := frame.Headers["transaction"]; prs {
+		return e.TM.AddFrame(tx, msg.ID, frame)
+	}
+
+	acked, err := e.AM.Ack(msg.ID, subID, ackID)
+	e.acknowledge(acked)
+	return err
+}
+
+func (e *Engine) handleNack(msg CnxMgrMsg, frame Frame) error {
+	if e.CM.Version(msg.ID) == VERSION_1_0 {
+		return fmt.Errorf("error: client %s: NACK is not supported in STOMP 1.0", msg.ID)
+	}
+
+	subID, ackID, err := e.ackTarget(msg, frame)
+	if err != nil {
+		return err
+	}
+
+	if tx, prs := frame.Headers["transaction"]; prs {
+		return e.TM.AddFrame(tx, msg.ID, frame)
+	}
+
+	nacked, err := e.AM.Nack(msg.ID, subID, ackID)
+	if err != nil {
+		return err
+	}
+
+	e.redeliver(nacked)
+	return nil
+}
+
+// ackTarget reads the headers identifying the message an ACK or NACK frame refers to,
+// which differ by protocol version: 1.2 uses id (the MESSAGE ack header),
+// 1.1 uses message-id and subscription, and 1.0 uses message-id alone
+func (e *Engine) ackTarget(msg CnxMgrMsg, frame Frame) (string, string, error) {
+	switch e.CM.Version(msg.ID) {
+	case VERSION_1_2:
+		ackID, prs := frame.Headers["id"]
+		if !prs {
+			return "", "", fmt.Errorf("error: client %s: no id header on %s frame", msg.ID, frame.Command)
+		}
+		return "", ackID, nil
+	case VERSION_1_1:
+		messageID, prs := frame.Headers["message-id"]
+		if !prs {
+			return "", "", fmt.Errorf("error: client %s: no message-id header on %s frame", msg.ID, frame.Command)
+		}
+		subID, prs := frame.Headers["subscription"]
+		if !prs {
+			return "", "", fmt.Errorf("error: client %s: no subscription header on %s frame", msg.ID, frame.Command)
+		}
+		return subID, messageID, nil
+	default:
+		messageID, prs := frame.Headers["message-id"]
+		if !prs {
+			return "", "", fmt.Errorf("error: client %s: no message-id header on %s frame", msg.ID, frame.Command)
+		}
+		return "", messageID, nil
+	}
+}
+
+// redeliver puts unacknowledged messages back at the head of their queues
+// iterating in reverse keeps them in their original delivery order
+// topic messages have already been fanned out to every subscriber, so they are not redelivered
+func (e *Engine) redeliver(msgs []PendingMessage) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if !isQueue(msgs[i].destination) {
+			log.Printf("REDELIVERY_SKIPPED: message on topic %s\n", msgs[i].destination)
+			continue
+		}
+		err := e.Store.Requeue(msgs[i].destination, msgs[i].frame)
+		if err != nil {
+			log.Printf("REDELIVERY_ERROR: dest %s: %v\n", msgs[i].destination, err)
+		} else {
+			log.Printf("REDELIVERING: message on dest %s\n", msgs[i].destination)
+		}
+	}
+}
+
+// acknowledge settles acknowledged messages in the store
+func (e *Engine) acknowledge(msgs []PendingMessage) {
+	for _, pm := range msgs {
+		e.settle(pm.destination, pm.frame)
+	}
+}
+
+// settle tells the store a popped message has been delivered for good, so it is not recovered after a restart
+func (e *Engine) settle(dest string, msg Frame) {
+	err := e.Store.Ack(dest, msg)
+	if err != nil {
+		log.Printf("STORE_ACK_ERROR: dest %s: %v\n", dest, err)
+	}
 }
 
 func (e *Engine) handleError(msg CnxMgrMsg, err error) error {
-	eFrame := UnmarshalFrame(Frame{
+	// echo back the offending frame's command and headers; frames that failed to parse have none
+	headers := map[string]string{"message": err.Error()}
+	body := ""
+	if msg.Err == nil {
+		body = "Original frame:\n" + msg.Frame.Command + "\n"
+		for k, v := range msg.Frame.Headers {
+			body += k + ":" + v + "\n"
+		}
+		// a client waiting on a receipt learns the frame failed instead
+		if receiptID, prs := msg.Frame.Headers["receipt"]; prs {
+			headers["receipt-id"] = receiptID
+		}
+	}
+	eFrame := UnmarshalFrameVersion(Frame{
 		Command: ERROR,
-		Headers: map[string]string{"message": err.Error()},
-		Body:    "Original frame: " + msg.Msg,
-	})
+		Headers: headers,
+		Body:    []byte(body),
+	}, e.CM.Version(msg.ID))
 	e.MS.IncError()
 	return e.CM.Write(msg.ID, eFrame)
 }
 
+// rejectFrame answers a frame that is not allowed in the session's current state
+// with an ERROR frame and closes the connection, as the specification requires
+func (e *Engine) rejectFrame(msg CnxMgrMsg, err error) {
+	err2 := e.handleError(msg, err)
+	if err2 != nil {
+		log.Printf("ERROR: client %s write error: %s\n", msg.ID, err2)
+	}
+	err2 = e.CM.Close(msg.ID)
+	if err2 != nil {
+		log.Printf("ERROR: client %s close error: %s\n", msg.ID, err2)
+	}
+}
+
+// reply answers a frame that has been handled: with an ERROR frame if handling it failed,
+// otherwise with a RECEIPT frame if the client asked for one
+func (e *Engine) reply(msg CnxMgrMsg, frame Frame, err error) {
+	if err != nil {
+		log.Println(err)
+		err = e.handleError(msg, err)
+	} else {
+		err = e.handleReceipt(msg, frame)
+	}
+	if err != nil {
+		log.Printf("ERROR: client %s write error: %s\n", msg.ID, err)
+	}
+}
+
 func (e *Engine) handleReceipt(msg CnxMgrMsg, frame Frame) error {
 	receiptID, prs := frame.Headers["receipt"]
 	if prs {
-		rFrame := UnmarshalFrame(Frame{
+		rFrame := UnmarshalFrameVersion(Frame{
 			Command: RECEIPT,
 			Headers: map[string]string{"receipt-id": receiptID},
-			Body:    "",
-		})
+			Body:    []byte{},
+		}, e.CM.Version(msg.ID))
 		return e.CM.Write(msg.ID, rFrame)
 	} else {
 		return nil
@@ -241,7 +655,6 @@ func (e *Engine) handleReceipt(msg CnxMgrMsg, frame Frame) error {
 
 func (e *Engine) handleSend(msg CnxMgrMsg, frame Frame) error {
 	// TODO: destination validation
-	// TODO: message ID creation
 	newHeaders := make(map[string]string)
 	for k, v := range frame.Headers {
 		newHeaders[k] = v
@@ -251,8 +664,13 @@ func (e *Engine) handleSend(msg CnxMgrMsg, frame Frame) error {
 	if !prs {
 		return fmt.Errorf("error: client %s: no destination header", msg.ID)
 	}
+	// the message may go to subscribers on any version, so its headers have to be writable to all of them
+	err := validateHeaders(frame.Headers)
+	if err != nil {
+		return fmt.Errorf("error: client %s: %v", msg.ID, err)
+	}
 
-	// if we have a
+	// frames in a transaction are authorized when it commits
 	tx, prs := frame.Headers["transaction"]
 	if prs {
 		txFrame := Frame{
@@ -263,6 +681,11 @@ func (e *Engine) handleSend(msg CnxMgrMsg, frame Frame) error {
 		return e.TM.AddFrame(tx, msg.ID, txFrame)
 	}
 
+	err = e.authorize(msg, dest, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+
 	messageFrame := prepareMessage(frame)
 
 	return e.Store.Enqueue(dest, messageFrame)
@@ -288,8 +711,9 @@ func (e *Engine) handleAbort(msg CnxMgrMsg, frame Frame) error {
 
 func (e *Engine) handleCommit(msg CnxMgrMsg, frame Frame) error {
 	// 1) receive transaction
-	// 2) Process all frames in transaction to MESSAGE
-	// 3) Enqueue Tx []Frame with e.Store.EnqueueTx
+	// 2) Check every frame in the transaction, so that none is applied if any would fail
+	// 3) Enqueue the SEND frames, processed to MESSAGE, with e.Store.EnqueueTx in the order they were sent
+	// 4) Apply the ACK and NACK frames
 	txId, ok := frame.Headers["transaction"]
 	if !ok {
 		return fmt.Errorf("commit %s: no transaction header", msg.ID)
@@ -300,22 +724,87 @@ func (e *Engine) handleCommit(msg CnxMgrMsg, frame Frame) error {
 		return fmt.Errorf("CommitTransaction: %v", err)
 	}
 
-	finalTx := make(map[string]Frame, len(tx.frames))
+	finalTx := make([]Frame, 0, len(tx.frames))
+	for i := range tx.frames {
+		switch tx.frames[i].Command {
+		case SEND:
+			// the whole transaction is dropped if any of its frames is denied
+			// the destination header is guaranteed by the initial handleSend call
+			err = e.authorize(msg, tx.frames[i].Headers["destination"], PERM_WRITE)
+			if err != nil {
+				return err
+			}
+			finalTx = append(finalTx, prepareMessage(tx.frames[i]))
+		case ACK, NACK:
+			subID, ackID, err := e.ackTarget(msg, tx.frames[i])
+			if err != nil {
+				return err
+			}
+			if !e.AM.IsPending(msg.ID, subID, ackID) {
+				return fmt.Errorf("commit %s: no pending message with ack ID %s", msg.ID, ackID)
+			}
+		}
+	}
+
+	if len(finalTx) > 0 {
+		err = e.Store.EnqueueTx(finalTx)
+		if err != nil {
+			return err
+		}
+	}
+
 	for i := range tx.frames {
-		newFr := prepareMessage(tx.frames[i])
-		dest := newFr.Headers["destination"] // should be guaranteed by initial handleSend call
-		finalTx[dest] = newFr
+		subID, ackID, _ := e.ackTarget(msg, tx.frames[i])
+		switch tx.frames[i].Command {
+		case ACK:
+			var acked []PendingMessage
+			acked, err = e.AM.Ack(msg.ID, subID, ackID)
+			e.acknowledge(acked)
+		case NACK:
+			var nacked []PendingMessage
+			nacked, err = e.AM.Nack(msg.ID, subID, ackID)
+			e.redeliver(nacked)
+		default:
+			continue
+		}
+		if err != nil {
+			// an earlier cumulative ACK or NACK in the transaction already resolved this message
+			log.Printf("commit %s: %v\n", msg.ID, err)
+		}
+	}
+	return nil
+}
+
+// authorize returns an error if the session's principal lacks perm on dest
+func (e *Engine) authorize(msg CnxMgrMsg, dest, perm string) error {
+	if e.ACL == nil {
+		return nil
+	}
+	principal := e.sessions[msg.ID].Principal
+	if e.ACL.Allowed(principal, dest, perm) {
+		return nil
 	}
+	e.MS.IncDenied()
+	log.Printf("ACCESS_DENIED: client %s as %q lacks %s on %s\n", msg.ID, principal.Name, perm, dest)
+	return fmt.Errorf("%w: %s permission required on %s", errAccessDenied, perm, dest)
+}
 
-	return e.Store.EnqueueTx(finalTx)
+// destinations under /queue/ are point-to-point: each message goes to exactly one subscriber
+// every other destination is treated as a topic and broadcasts to all subscribers
+func isQueue(dest string) bool {
+	return strings.HasPrefix(dest, "/queue/")
 }
 
 // deep copy a SEND frame to a message frame to avoid race conditions
+// this happens at enqueue time, so it is also where the broker stamps each message
+// with its message-id and receive timestamp (milliseconds since the epoch)
 func prepareMessage(frame Frame) Frame {
 	newHeaders := make(map[string]string)
 	for k, v := range frame.Headers {
 		newHeaders[k] = v
 	}
+	newHeaders["message-id"] = newMessageID()
+	newHeaders["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
 
 	return Frame{
 		Command: MESSAGE,
@@ -324,69 +813,257 @@ func prepareMessage(frame Frame) Frame {
 	}
 }
 
+// newMessageID returns a version 7 UUID, which is unique and sorts in creation order
+func newMessageID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		log.Printf("MESSAGE_ID: falling back to random ID: %v\n", err)
+		return uuid.NewString()
+	}
+	return id.String()
+}
+
 // msg is of type []Frame
 // if len(msg) == 1 that means we're sending a regular message
 // if len(msg) > 1 that means we're working with a transaction
 type SendJob struct {
 	msg           []Frame
 	subscriptions []Subscription
+	reserved      bool // room for the message was claimed on its one subscriber's connection
 }
 
-func (e *Engine) SendWorker(id int, jobs <-chan SendJob) {
+func (e *Engine) SendWorker(id int, jobs <-chan SendJob, freed chan<- struct{}) {
 	for j := range jobs {
 		if len(j.msg) == 1 {
+			msg := j.msg[0]
+			messageID, prs := msg.Headers["message-id"]
+			if !prs {
+				// messages are stamped at enqueue time, but a store written by an older
+				// version may not have been; popped frames are owned by this job, so the ID
+				// sticks if the message is redelivered
+				messageID = newMessageID()
+				msg.Headers["message-id"] = messageID
+			}
+			dest := msg.Headers["destination"]
+
 			for _, sub := range j.subscriptions {
-				msg := j.msg[0]
 				clientID := sub.ClientID
+				version := e.CM.Version(clientID)
 				uniqueHeaders := make(map[string]string)
 				for k, v := range msg.Headers {
 					uniqueHeaders[k] = v
 				}
 				uniqueHeaders["subscription"] = sub.ID
 
+				// in client ack modes, the message is tracked before it is written
+				// so that an ACK arriving right after the write always finds it
+				// only 1.2 has the ack header; earlier versions acknowledge by message-id
+				ackID := ""
+				if sub.AckMode != ACK_AUTO {
+					if version == VERSION_1_2 {
+						ackID = uuid.NewString()
+						uniqueHeaders["ack"] = ackID
+					} else {
+						ackID = messageID
+					}
+					e.AM.Add(clientID, PendingMessage{
+						ackID:       ackID,
+						subID:       sub.ID,
+						ackMode:     sub.AckMode,
+						destination: dest,
+						frame:       msg,
+					})
+				}
+
 				uFrame := Frame{
 					Command: msg.Command,
 					Headers: uniqueHeaders,
 					Body:    msg.Body,
 				}
-				uFrString := UnmarshalFrame(uFrame)
-				err := e.CM.Write(clientID, uFrString)
+				// the client never gets a message that fails to write or that its slow consumer policy
+				// drops, so a queue message goes back for someone else
+				subID := sub.ID
+				unsent := func() {
+					if ackID != "" {
+						pending, err := e.AM.Nack(clientID, subID, ackID)
+						if err == nil {
+							e.redeliver(pending)
+						}
+					} else if isQueue(dest) {
+						e.redeliver([]PendingMessage{{destination: dest, frame: msg}})
+					}
+				}
+				uFrString := UnmarshalFrameVersion(uFrame, version)
+				err := e.CM.WriteMessage(clientID, uFrString, j.reserved, unsent)
 				if err != nil {
 					log.Printf("worker %d: SEND_ERROR: %s\n", id, err)
 					e.MS.IncError()
+					unsent()
 				} else {
 					e.MS.IncSent()
+					// in auto mode, handing the message to the connection is as delivered as it gets
+					if ackID == "" && isQueue(dest) {
+						e.settle(dest, msg)
+					}
 				}
 			}
 		}
+		select {
+		case freed <- struct{}{}:
+		default:
+		}
 	}
 }
 
+// WorkerManager hands each stored message to the send worker that owns its destination. Every
+// destination belongs to one worker, which delivers its jobs in order, so subscribers see a
+// destination's messages in the order they were popped while other destinations are sent in parallel.
 func (e *Engine) WorkerManager(numWorkers int) {
 	log.Printf("starting %d workers\n", numWorkers)
 
-	sChan := make(chan SendJob)
-	for i := 0; i < numWorkers; i++ {
-		go e.SendWorker(i, sChan)
+	workers := make([]chan SendJob, numWorkers)
+	// a worker stuck on a slow connection leaves the dispatch loop skipping its destinations,
+	// so it signals here each time it finishes a job
+	freed := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan SendJob, workerBacklog)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			e.SendWorker(id, workers[id], freed)
+		}(i)
 	}
+
+	// take the notify channels before the first pass, so a message stored during that pass still wakes us;
+	// a MemoryStore only starts signalling once Notify has been called
+	stored := e.Store.Notify()
+	subscribed := e.SM.Notify()
+	drained := e.CM.Notify()
+
+	// round-robin position per queue destination, used to break ties between equally loaded consumers
+	next := make(map[string]int)
 	for {
-		dests := e.Store.Destinations()
-		for j := range dests {
-			dest := dests[j]
-			count, err := e.Store.Len(dest)
-			if err != nil {
-				log.Printf("SEND_ERROR: No such destination\n")
+		select {
+		case <-e.stopDispatch:
+			// stop taking messages from the store, but let the workers finish the jobs they have
+			for _, w := range workers {
+				close(w)
 			}
-			if count > 0 {
-				subscribers := e.SM.ClientsByDestination(dest)
-				messageFrame, err := e.Store.Pop(dest)
-				if err != nil {
-					log.Println(err)
-				} else {
-					log.Printf("SENDING_MESSAGE: on queue %s to %d subscribers\n", dest, len(subscribers))
-					sChan <- SendJob{msg: messageFrame, subscriptions: subscribers}
+			wg.Wait()
+			close(e.dispatchDone)
+			return
+		default:
+		}
+
+		if e.dispatch(next, workers) {
+			continue
+		}
+		// nothing could be sent, so sleep until a message arrives, a subscriber appears
+		// or a worker or connection catches up
+		select {
+		case <-stored:
+		case <-subscribed:
+		case <-freed:
+		case <-drained:
+		case <-e.stopDispatch:
+		}
+	}
+}
+
+// dispatch makes one pass over the destinations, handing at most one message from each to the
+// send worker that owns it, and reports whether it took any message from the store. A destination
+// whose worker already has a full backlog is skipped, leaving its messages in the store, so one
+// stalled consumer does not hold up the destinations owned by other workers.
+func (e *Engine) dispatch(next map[string]int, workers []chan SendJob) bool {
+	popped := false
+	dests := e.Store.Destinations()
+	for j := range dests {
+		dest := dests[j]
+		worker := workers[workerFor(dest, len(workers))]
+		// only this loop sends to the workers, so a backlog with room cannot fill up before the send below
+		if len(worker) == cap(worker) {
+			continue
+		}
+		count, err := e.Store.Len(dest)
+		if err != nil {
+			log.Printf("SEND_ERROR: No such destination\n")
+		}
+		if count > 0 {
+			// a connection that has gone but whose close the engine has yet to handle is skipped,
+			// otherwise its queue messages would be popped and requeued over and over
+			subscribers := e.filterSubscribers(e.SM.ClientsByDestination(dest), e.CM.Open)
+			if isQueue(dest) {
+				// likewise a consumer with a full outbound queue, whose slow consumer policy would
+				// only drop the message back into the queue or hold up the send worker
+				subscribers = e.filterSubscribers(subscribers, e.CM.HasRoom)
+				// queue messages stay in the store until there is a consumer to take them
+				if len(subscribers) == 0 {
+					continue
+				}
+				subscribers = []Subscription{e.selectConsumer(subscribers, next[dest])}
+				next[dest]++
+			}
+			messageFrame, err := e.Store.Pop(dest)
+			if err != nil {
+				log.Println(err)
+			} else {
+				popped = true
+				log.Printf("SENDING_MESSAGE: on queue %s to %d subscribers\n", dest, len(subscribers))
+				if !isQueue(dest) {
+					// topic messages are never redelivered, so they are done with once popped
+					for _, f := range messageFrame {
+						e.settle(dest, f)
+					}
 				}
+				// claim the consumer's room now, so the next pass does not pick it again for a message
+				// that would not fit; only a topic message written in between can have taken it
+				reserved := isQueue(dest) && e.CM.Reserve(subscribers[0].ClientID)
+				worker <- SendJob{msg: messageFrame, subscriptions: subscribers, reserved: reserved}
 			}
 		}
 	}
+	return popped
+}
+
+// workerBacklog is how many popped messages each send worker may have waiting
+const workerBacklog = 16
+
+// workerFor maps a destination to the one of n send workers that delivers all of its messages
+func workerFor(dest string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(dest))
+	return int(h.Sum32() % uint32(n))
+}
+
+// filterSubscribers returns the subscriptions whose connections pass ok
+func (e *Engine) filterSubscribers(subscribers []Subscription, ok func(clientID string) bool) []Subscription {
+	kept := subscribers[:0]
+	for _, sub := range subscribers {
+		if ok(sub.ClientID) {
+			kept = append(kept, sub)
+		}
+	}
+	return kept
+}
+
+// selectConsumer picks the competing consumer for one queue message: the subscription with
+// the fewest unacknowledged messages, starting the search at a rotating offset so that
+// consumers in auto ack mode (which never have pending messages) are served round-robin
+func (e *Engine) selectConsumer(subscribers []Subscription, offset int) Subscription {
+	sort.Slice(subscribers, func(i, j int) bool {
+		return subscribers[i].InternalSubID() < subscribers[j].InternalSubID()
+	})
+
+	best := offset % len(subscribers)
+	bestCount := e.AM.PendingCount(subscribers[best].ClientID, subscribers[best].ID)
+	for i := 1; i < len(subscribers); i++ {
+		candidate := (offset + i) % len(subscribers)
+		count := e.AM.PendingCount(subscribers[candidate].ClientID, subscribers[candidate].ID)
+		if count < bestCount {
+			best = candidate
+			bestCount = count
+		}
+	}
+	return subscribers[best]
 }
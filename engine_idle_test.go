@@ -0,0 +1,28 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// BenchmarkIdleDispatch reports the CPU time the dispatch loop uses per second while there is nothing to send
+func BenchmarkIdleDispatch(b *testing.B) {
+	newDispatchEngine(b, 1, "/queue/bench")
+	time.Sleep(10 * time.Millisecond) // let the dispatch loop reach its first wait
+
+	var before, after syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &before)
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	syscall.Getrusage(syscall.RUSAGE_SELF, &after)
+
+	cpu := time.Duration(after.Utime.Nano()+after.Stime.Nano()) - time.Duration(before.Utime.Nano()+before.Stime.Nano())
+	b.ReportMetric(float64(cpu)/elapsed.Seconds(), "cpu-ns/s")
+}
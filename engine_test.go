@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPrepareMessage(t *testing.T) {
+	send := Frame{
+		Command: SEND,
+		Headers: map[string]string{"destination": "/queue/test", "message-id": "client-chosen"},
+		Body:    []byte("body"),
+	}
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	prev := ""
+	for i := 0; i < 100; i++ {
+		msg := prepareMessage(send)
+		if msg.Command != MESSAGE {
+			t.Errorf("got command %s wanted %s", msg.Command, MESSAGE)
+		}
+		id := msg.Headers["message-id"]
+		if id == "client-chosen" || id == "" {
+			t.Fatalf("message-id not assigned by the broker: %q", id)
+		}
+		if id <= prev {
+			t.Errorf("message IDs not increasing: %s followed %s", id, prev)
+		}
+		prev = id
+
+		ts, err := strconv.ParseInt(msg.Headers["timestamp"], 10, 64)
+		if err != nil {
+			t.Fatal("bad timestamp header: ", err)
+		}
+		if ts < before || ts > time.Now().UnixNano()/int64(time.Millisecond) {
+			t.Errorf("timestamp %d out of range", ts)
+		}
+	}
+
+	if send.Headers["message-id"] != "client-chosen" {
+		t.Error("prepareMessage modified the SEND frame's headers")
+	}
+}
+
+// readServerFrame reads the next frame from the server, skipping heart-beats
+func readServerFrame(t *testing.T, fr *FrameReader) Frame {
+	for {
+		hb, err := fr.ReadHeartbeat()
+		if err != nil {
+			t.Fatal("read error: ", err)
+		}
+		if hb {
+			continue
+		}
+		frame, err := fr.ReadFrame(VERSION_1_2)
+		if err != nil {
+			t.Fatal("read error: ", err)
+		}
+		return frame
+	}
+}
+
+func TestEngineShutdown(t *testing.T) {
+	messages := make(chan CnxMgrMsg)
+	cm := NewConnectionManager("", 32808, messages, 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/test": {}}}
+	e := NewEngine(st, cm, messages, 1, false, "", 0)
+
+	started := make(chan error)
+	go func() {
+		started <- e.Start()
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("tcp", ":32808")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("could not connect to server: ", err)
+	}
+	defer conn.Close()
+	fr := NewFrameReader(conn)
+
+	conn.Write([]byte("CONNECT\naccept-version:1.2\n\n\000"))
+	if f := readServerFrame(t, fr); f.Command != CONNECTED {
+		t.Fatalf("expected CONNECTED, got %+v", f)
+	}
+	conn.Write([]byte("SUBSCRIBE\nid:0\ndestination:/queue/test\nack:client\nreceipt:1\n\n\000"))
+	if f := readServerFrame(t, fr); f.Command != RECEIPT {
+		t.Fatalf("expected RECEIPT, got %+v", f)
+	}
+	conn.Write([]byte("SEND\ndestination:/queue/test\n\nunacked\000"))
+	if f := readServerFrame(t, fr); f.Command != MESSAGE || string(f.Body) != "unacked" {
+		t.Fatalf("expected MESSAGE, got %+v", f)
+	}
+
+	e.Shutdown(2 * time.Second)
+
+	f := readServerFrame(t, fr)
+	if f.Command != ERROR || f.Headers["message"] != errShuttingDown.Error() {
+		t.Errorf("expected shutdown ERROR, got %+v", f)
+	}
+	_, err = fr.ReadHeartbeat()
+	if err == nil {
+		t.Error("connection still open after shutdown")
+	}
+
+	select {
+	case err = <-started:
+		if err != nil {
+			t.Errorf("Start returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+
+	// the unacknowledged message is back in the store, and no new connections are accepted
+	n, _ := st.Len("/queue/test")
+	if n != 1 {
+		t.Errorf("got %d messages in store after shutdown, wanted 1", n)
+	}
+	_, err = net.Dial("tcp", ":32808")
+	if err == nil {
+		t.Error("server still accepting connections after shutdown")
+	}
+}
+
+func TestEngineShutdownTimeout(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.AddDestination("/queue/slow")
+	fs.AddDestination("/topic/slow")
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(fs, cm, cm.messages, 1, false, "", 0)
+
+	// a client that reads nothing holds up the send worker with topic messages,
+	// so draining times out waiting for it
+	server, client := net.Pipe()
+	defer client.Close()
+	cm.connections["c1"] = NewConnection(server, "c1", OutboundConfig{QueueSize: 1, Policy: SLOW_CONSUMER_BLOCK})
+	cm.SetVersion("c1", VERSION_1_2)
+	e.SM.Subscribe("c1", "0", "/topic/slow", ACK_AUTO)
+	e.SM.Subscribe("c1", "1", "/queue/slow", ACK_AUTO)
+
+	started := make(chan error)
+	go func() {
+		started <- e.Start()
+	}()
+	e.Incoming <- CnxMgrMsg{Type: NEW_CONNECTION, ID: "c1"}
+	enqueue := func(dest string, n int) {
+		send := Frame{Command: SEND, Headers: map[string]string{"destination": dest}, Body: []byte{}}
+		for i := 0; i < n; i++ {
+			fs.Enqueue(dest, prepareMessage(send))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// one topic message goes to the writer, one fills the client's queue and the worker waits with the third
+	enqueue("/topic/slow", 3)
+	enqueue("/queue/slow", 2)
+
+	e.Shutdown(50 * time.Millisecond)
+	select {
+	case err = <-started:
+		if err != nil {
+			t.Errorf("Start returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+
+	// closing the connection releases the worker; the queue messages were never taken,
+	// since the client had no room for them, so they are still in the store
+	<-e.dispatchDone
+	fs.Close()
+	fs, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if n, _ := fs.Len("/queue/slow"); n != 2 {
+		t.Errorf("got %d messages in store after shutdown wanted 2", n)
+	}
+}
+
+// newDispatchEngine starts the send workers of an engine whose one client is subscribed
+// to each of dests over an in-memory pipe, returning the engine and the client's end of the pipe
+func newDispatchEngine(tb testing.TB, workers int, dests ...string) (*Engine, net.Conn) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{}}
+	e := NewEngine(st, cm, cm.messages, workers, false, "", 0)
+
+	server, client := net.Pipe()
+	cm.connections["bench"] = NewConnection(server, "bench", DefaultOutboundConfig)
+	cm.SetVersion("bench", VERSION_1_2)
+	for i, dest := range dests {
+		st.AddDestination(dest)
+		err := e.SM.Subscribe("bench", strconv.Itoa(i), dest, ACK_AUTO)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	go e.WorkerManager(workers)
+	tb.Cleanup(func() {
+		close(e.stopDispatch)
+		client.Close()
+		<-e.dispatchDone
+	})
+	return e, client
+}
+
+func TestDispatchOrder(t *testing.T) {
+	dests := []string{"/queue/a", "/queue/b", "/queue/c", "/topic/d", "/topic/e"}
+	e, client := newDispatchEngine(t, 4, dests...)
+	fr := NewFrameReader(client)
+
+	const perDest = 200
+	for i := 0; i < perDest; i++ {
+		for _, dest := range dests {
+			send := Frame{
+				Command: SEND,
+				Headers: map[string]string{"destination": dest},
+				Body:    []byte(strconv.Itoa(i)),
+			}
+			err := e.Store.Enqueue(dest, prepareMessage(send))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	next := make(map[string]int)
+	for i := 0; i < perDest*len(dests); i++ {
+		f := readServerFrame(t, fr)
+		dest := f.Headers["destination"]
+		if string(f.Body) != strconv.Itoa(next[dest]) {
+			t.Fatalf("on %s got message %s wanted %d", dest, f.Body, next[dest])
+		}
+		next[dest]++
+	}
+}
+
+// dispatchClient connects a client to e's ConnectionManager over an in-memory pipe and
+// returns a channel of the frames the client receives
+func dispatchClient(t *testing.T, e *Engine, id string) <-chan Frame {
+	server, client := net.Pipe()
+	e.CM.mu.Lock()
+	e.CM.connections[id] = NewConnection(server, id, DefaultOutboundConfig)
+	e.CM.mu.Unlock()
+	e.CM.SetVersion(id, VERSION_1_2)
+	t.Cleanup(func() { client.Close() })
+
+	frames := make(chan Frame, 100)
+	go func() {
+		fr := NewFrameReader(client)
+		for {
+			f, err := fr.ReadFrame(VERSION_1_2)
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	return frames
+}
+
+// receive returns the bodies of the frames a client receives until none arrive for a while
+func receive(frames <-chan Frame) []string {
+	var bodies []string
+	for {
+		select {
+		case f := <-frames:
+			bodies = append(bodies, string(f.Body))
+		case <-time.After(100 * time.Millisecond):
+			return bodies
+		}
+	}
+}
+
+func TestDispatchConsumers(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/rr": {}, "/queue/pending": {}, "/topic/t": {}}}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	c1 := dispatchClient(t, e, "c1")
+	c2 := dispatchClient(t, e, "c2")
+	go e.WorkerManager(1)
+	defer func() {
+		close(e.stopDispatch)
+		<-e.dispatchDone
+	}()
+
+	enqueue := func(dest string, n int) {
+		for i := 0; i < n; i++ {
+			send := Frame{Command: SEND, Headers: map[string]string{"destination": dest}, Body: []byte(dest)}
+			err := st.Enqueue(dest, prepareMessage(send))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("_QueueRoundRobin", func(t *testing.T) {
+		e.SM.Subscribe("c1", "rr", "/queue/rr", ACK_AUTO)
+		e.SM.Subscribe("c2", "rr", "/queue/rr", ACK_AUTO)
+		enqueue("/queue/rr", 4)
+		got1, got2 := receive(c1), receive(c2)
+		if len(got1) != 2 || len(got2) != 2 {
+			t.Errorf("got %d and %d messages wanted 2 each", len(got1), len(got2))
+		}
+	})
+
+	t.Run("_QueueLeastPending", func(t *testing.T) {
+		// c1 never acknowledges, so after its first message everything goes to c2
+		e.SM.Subscribe("c1", "pending", "/queue/pending", ACK_CLIENT_INDIVIDUAL)
+		e.SM.Subscribe("c2", "pending", "/queue/pending", ACK_AUTO)
+		for i := 0; i < 4; i++ {
+			enqueue("/queue/pending", 1)
+			time.Sleep(10 * time.Millisecond)
+		}
+		got1, got2 := receive(c1), receive(c2)
+		if len(got1) != 1 || len(got2) != 3 {
+			t.Errorf("got %d and %d messages wanted 1 and 3", len(got1), len(got2))
+		}
+	})
+
+	t.Run("_TopicBroadcast", func(t *testing.T) {
+		e.SM.Subscribe("c1", "t", "/topic/t", ACK_AUTO)
+		e.SM.Subscribe("c2", "t", "/topic/t", ACK_AUTO)
+		enqueue("/topic/t", 2)
+		got1, got2 := receive(c1), receive(c2)
+		if len(got1) != 2 || len(got2) != 2 {
+			t.Errorf("got %d and %d messages wanted 2 each", len(got1), len(got2))
+		}
+	})
+}
+
+func TestDispatchHeldUntilSubscribed(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/held": {}}}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	c1 := dispatchClient(t, e, "c1")
+	go e.WorkerManager(1)
+	defer func() {
+		close(e.stopDispatch)
+		<-e.dispatchDone
+	}()
+
+	send := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/held"}, Body: []byte("held")}
+	err := st.Enqueue("/queue/held", prepareMessage(send))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := st.Len("/queue/held"); n != 1 {
+		t.Fatalf("got %d messages held with no subscribers wanted 1", n)
+	}
+
+	e.SM.Subscribe("c1", "0", "/queue/held", ACK_AUTO)
+	got := receive(c1)
+	if len(got) != 1 || got[0] != "held" {
+		t.Errorf("got %v wanted the held message", got)
+	}
+}
+
+// firstPassStore stores a message while the dispatcher lists destinations for its first pass,
+// after the list has been taken
+type firstPassStore struct {
+	*MemoryStore
+	once sync.Once
+	msg  Frame
+}
+
+func (s *firstPassStore) Destinations() []string {
+	dests := s.MemoryStore.Destinations()
+	first := false
+	s.once.Do(func() {
+		first = true
+		s.MemoryStore.Enqueue(s.msg.Headers["destination"], s.msg)
+	})
+	if first {
+		return nil
+	}
+	return dests
+}
+
+func TestDispatchWakesOnFirstPass(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	send := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/first"}, Body: []byte("first")}
+	st := &firstPassStore{
+		MemoryStore: &MemoryStore{Queues: map[string][][]Frame{"/queue/first": {}}},
+		msg:         prepareMessage(send),
+	}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	c1 := dispatchClient(t, e, "c1")
+	e.SM.Subscribe("c1", "0", "/queue/first", ACK_AUTO)
+	<-e.SM.Notify() // only the store's signal may wake the dispatcher
+
+	go e.WorkerManager(1)
+	defer func() {
+		close(e.stopDispatch)
+		<-e.dispatchDone
+	}()
+	select {
+	case <-c1:
+	case <-time.After(time.Second):
+		t.Fatal("message stored during the first dispatch pass was not delivered")
+	}
+}
+
+// popCountingStore counts how often messages are popped
+type popCountingStore struct {
+	*MemoryStore
+	pops int32
+}
+
+func (s *popCountingStore) Pop(destination string) ([]Frame, error) {
+	atomic.AddInt32(&s.pops, 1)
+	return s.MemoryStore.Pop(destination)
+}
+
+func TestDispatchConsumerGone(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &popCountingStore{MemoryStore: &MemoryStore{Queues: map[string][][]Frame{"/queue/gone": {}}}}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	dispatchClient(t, e, "c1")
+	e.SM.Subscribe("c1", "0", "/queue/gone", ACK_AUTO)
+
+	// the connection fails, but the engine has not handled its CONNECTION_CLOSED yet
+	c := cm.connections["c1"]
+	c.Close()
+	<-c.written
+
+	go e.WorkerManager(1)
+	defer func() {
+		close(e.stopDispatch)
+		<-e.dispatchDone
+	}()
+	send := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/gone"}, Body: []byte{}}
+	st.Enqueue("/queue/gone", prepareMessage(send))
+	time.Sleep(100 * time.Millisecond)
+
+	if n, _ := st.Len("/queue/gone"); n != 1 {
+		t.Errorf("got %d messages held wanted 1", n)
+	}
+	if n := atomic.LoadInt32(&st.pops); n != 0 {
+		t.Errorf("message popped %d times for a consumer whose connection is gone", n)
+	}
+}
+
+func TestDispatchStalledDestination(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &MemoryStore{Queues: map[string][][]Frame{"/topic/a": {}, "/queue/b": {}}}
+	if workerFor("/topic/a", 2) == workerFor("/queue/b", 2) {
+		t.Fatal("test destinations must belong to different workers")
+	}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 2, false, "", 0)
+
+	// the subscriber to /topic/a reads nothing, so its worker blocks writing to it
+	server, client := net.Pipe()
+	defer client.Close()
+	cm.connections["stalled"] = NewConnection(server, "stalled", OutboundConfig{QueueSize: 1, Policy: SLOW_CONSUMER_BLOCK})
+	cm.SetVersion("stalled", VERSION_1_2)
+	e.SM.Subscribe("stalled", "0", "/topic/a", ACK_AUTO)
+	frames := dispatchClient(t, e, "c1")
+	e.SM.Subscribe("c1", "0", "/queue/b", ACK_AUTO)
+
+	go e.WorkerManager(2)
+	defer func() {
+		close(e.stopDispatch)
+		client.Close()
+		<-e.dispatchDone
+	}()
+	for i := 0; i < 2*workerBacklog; i++ {
+		send := Frame{Command: SEND, Headers: map[string]string{"destination": "/topic/a"}, Body: []byte("a")}
+		st.Enqueue("/topic/a", prepareMessage(send))
+	}
+	time.Sleep(50 * time.Millisecond)
+	send := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/b"}, Body: []byte("b")}
+	st.Enqueue("/queue/b", prepareMessage(send))
+
+	if got := receive(frames); len(got) != 1 {
+		t.Errorf("got %d messages on /queue/b while /topic/a was stalled wanted 1", len(got))
+	}
+	// what the stalled worker could not take stays in the store
+	if n, _ := st.Len("/topic/a"); n == 0 {
+		t.Error("every /topic/a message was popped for a stalled subscriber")
+	}
+}
+
+func TestDispatchConsumerFull(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &popCountingStore{MemoryStore: &MemoryStore{Queues: map[string][][]Frame{"/queue/full": {}}}}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+
+	// the consumer is not reading, so one message fills its outbound queue
+	c, client := queueBehindWriter(t, OutboundConfig{QueueSize: 1, Policy: SLOW_CONSUMER_DROP_OLDEST})
+	defer client.Close()
+	c.drained = cm.drained
+	cm.connections["c1"] = c
+	cm.SetVersion("c1", VERSION_1_2)
+	e.SM.Subscribe("c1", "0", "/queue/full", ACK_AUTO)
+
+	go e.WorkerManager(1)
+	defer func() {
+		close(e.stopDispatch)
+		client.Close()
+		<-e.dispatchDone
+	}()
+	const sent = 5
+	for i := 0; i < sent; i++ {
+		send := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/full"}, Body: []byte(strconv.Itoa(i))}
+		st.Enqueue("/queue/full", prepareMessage(send))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the rest wait in the store rather than being dropped and requeued over and over
+	if n := atomic.LoadInt32(&st.pops); n != 1 {
+		t.Errorf("got %d messages popped for a full consumer wanted 1", n)
+	}
+
+	// once the consumer reads, the rest follow in order
+	fr := NewFrameReader(client)
+	readN(t, client, 1)
+	for i := 0; i < sent; i++ {
+		f := readServerFrame(t, fr)
+		if string(f.Body) != strconv.Itoa(i) {
+			t.Fatalf("got message %s wanted %d", f.Body, i)
+		}
+	}
+}
+
+func TestSendWorkerRequeue(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/test": {}, "/topic/test": {}}}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+
+	// the subscribers' connections are gone, so every write fails
+	jobs := make(chan SendJob, 3)
+	for _, dest := range []string{"/queue/test", "/topic/test"} {
+		for _, mode := range []string{ACK_AUTO, ACK_CLIENT_INDIVIDUAL} {
+			if dest == "/topic/test" && mode != ACK_AUTO {
+				continue
+			}
+			msg := prepareMessage(Frame{Command: SEND, Headers: map[string]string{"destination": dest}, Body: []byte{}})
+			jobs <- SendJob{
+				msg:           []Frame{msg},
+				subscriptions: []Subscription{{ID: "0", Destination: dest, ClientID: "gone", AckMode: mode}},
+			}
+		}
+	}
+	close(jobs)
+	e.SendWorker(0, jobs, nil)
+
+	if n, _ := st.Len("/queue/test"); n != 2 {
+		t.Errorf("got %d queue messages requeued wanted 2", n)
+	}
+	if n, _ := st.Len("/topic/test"); n != 0 {
+		t.Errorf("got %d topic messages requeued wanted 0", n)
+	}
+}
+
+func TestSendWorkerDropOldest(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/auto": {}, "/queue/client": {}}}
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+
+	// the client reads nothing, so each message queued for it drops the one before
+	c, client := queueBehindWriter(t, OutboundConfig{QueueSize: 1, Policy: SLOW_CONSUMER_DROP_OLDEST})
+	defer client.Close()
+	cm.connections["c1"] = c
+	cm.SetVersion("c1", VERSION_1_2)
+
+	jobs := make(chan SendJob, 4)
+	for _, mode := range []string{ACK_AUTO, ACK_CLIENT_INDIVIDUAL} {
+		dest := "/queue/auto"
+		if mode != ACK_AUTO {
+			dest = "/queue/client"
+		}
+		for i := 0; i < 2; i++ {
+			msg := prepareMessage(Frame{Command: SEND, Headers: map[string]string{"destination": dest}, Body: []byte{}})
+			jobs <- SendJob{
+				msg:           []Frame{msg},
+				subscriptions: []Subscription{{ID: mode, Destination: dest, ClientID: "c1", AckMode: mode}},
+			}
+		}
+	}
+	close(jobs)
+	e.SendWorker(0, jobs, nil)
+
+	// all but the last message are dropped unsent and go back to their queues;
+	// the dropped client ack message is no longer pending
+	if n, _ := st.Len("/queue/auto"); n != 2 {
+		t.Errorf("got %d auto ack messages requeued wanted 2", n)
+	}
+	if n, _ := st.Len("/queue/client"); n != 1 {
+		t.Errorf("got %d client ack messages requeued wanted 1", n)
+	}
+	if n := e.AM.PendingCount("c1", ACK_CLIENT_INDIVIDUAL); n != 1 {
+		t.Errorf("got %d client ack messages pending wanted 1", n)
+	}
+}
+
+func BenchmarkPublishToDeliver(b *testing.B) {
+	e, client := newDispatchEngine(b, 1, "/queue/bench")
+	fr := NewFrameReader(client)
+	send := Frame{
+		Command: SEND,
+		Headers: map[string]string{"destination": "/queue/bench"},
+		Body:    []byte("payload"),
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := e.Store.Enqueue("/queue/bench", prepareMessage(send))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = fr.ReadFrame(VERSION_1_2)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCommitAcks(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/in": {}, "/queue/out": {}}}
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	msg := CnxMgrMsg{Type: FRAME, ID: "client1"}
+	in := Frame{Command: MESSAGE, Headers: map[string]string{"destination": "/queue/in"}, Body: []byte("in")}
+	e.AM.Add(msg.ID, PendingMessage{ackID: "m1", subID: "0", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/queue/in", frame: in})
+	e.AM.Add(msg.ID, PendingMessage{ackID: "m2", subID: "0", ackMode: ACK_CLIENT_INDIVIDUAL, destination: "/queue/in", frame: in})
+
+	frame := func(command string, headers ...string) Frame {
+		f := Frame{Command: command, Headers: map[string]string{"transaction": "tx1"}, Body: []byte("out")}
+		for i := 0; i < len(headers); i += 2 {
+			f.Headers[headers[i]] = headers[i+1]
+		}
+		return f
+	}
+
+	// the ACK and NACK are only applied with the SEND, when the transaction commits
+	// (connections without a negotiated version acknowledge by message-id)
+	err := e.handleBegin(msg, frame(BEGIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []Frame{
+		frame(ACK, "message-id", "m1"),
+		frame(SEND, "destination", "/queue/out"),
+		frame(NACK, "message-id", "m2"),
+	} {
+		var err error
+		switch f.Command {
+		case ACK:
+			err = e.handleAck(msg, f)
+		case NACK:
+			err = e.handleNack(msg, f)
+		case SEND:
+			err = e.handleSend(msg, f)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := e.AM.PendingCount(msg.ID, "0"); n != 2 {
+		t.Errorf("got %d pending messages before commit wanted 2", n)
+	}
+
+	err = e.handleCommit(msg, frame(COMMIT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := e.AM.PendingCount(msg.ID, "0"); n != 0 {
+		t.Errorf("got %d pending messages after commit wanted 0", n)
+	}
+	if n, _ := st.Len("/queue/out"); n != 1 {
+		t.Errorf("got %d messages sent wanted 1", n)
+	}
+	if n, _ := st.Len("/queue/in"); n != 1 {
+		t.Errorf("got %d messages redelivered wanted 1", n)
+	}
+
+	// a transaction acknowledging a message that isn't pending commits nothing
+	e.handleBegin(msg, frame(BEGIN))
+	e.handleSend(msg, frame(SEND, "destination", "/queue/out"))
+	e.handleAck(msg, frame(ACK, "message-id", "m1"))
+	err = e.handleCommit(msg, frame(COMMIT))
+	if err == nil {
+		t.Error("committed an ACK of a message that is not pending")
+	}
+	if n, _ := st.Len("/queue/out"); n != 1 {
+		t.Errorf("got %d messages sent wanted 1", n)
+	}
+}
+
+func TestClientAckRecovery(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.AddDestination("/queue/acked")
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(fs, cm, cm.messages, 1, false, "", 0)
+	frames := dispatchClient(t, e, "c1")
+	e.SM.Subscribe("c1", "0", "/queue/acked", ACK_CLIENT_INDIVIDUAL)
+
+	go e.WorkerManager(1)
+	for _, body := range []string{"acked", "unacked"} {
+		send := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/acked"}, Body: []byte(body)}
+		fs.Enqueue("/queue/acked", prepareMessage(send))
+	}
+	var delivered []Frame
+	for i := 0; i < 2; i++ {
+		select {
+		case f := <-frames:
+			delivered = append(delivered, f)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+	err = e.handleAck(CnxMgrMsg{Type: FRAME, ID: "c1"}, Frame{Command: ACK, Headers: map[string]string{"id": delivered[0].Headers["ack"]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(e.stopDispatch)
+	<-e.dispatchDone
+
+	// a crash leaves the delivered but unacknowledged message in the log
+	fs.Close()
+	fs, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	got, err := fs.Pop("/queue/acked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[0].Body) != "unacked" {
+		t.Errorf("got %q recovered wanted %q", got[0].Body, "unacked")
+	}
+	if n, _ := fs.Len("/queue/acked"); n != 0 {
+		t.Errorf("got %d more messages recovered wanted 0", n)
+	}
+}
+
+// startLoop runs e's main loop with one client, connected as id over an in-memory pipe, and returns
+// the client's end of the pipe and a function that hands the loop a frame from the client.
+// The engine is shut down when the test ends.
+func startLoop(t *testing.T, e *Engine, id string) (net.Conn, func(command string, headers ...string)) {
+	log.SetOutput(io.Discard)
+	server, client := net.Pipe()
+	e.CM.connections[id] = NewConnection(server, id, DefaultOutboundConfig)
+
+	started := make(chan error)
+	go func() {
+		started <- e.Start()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		e.Shutdown(time.Second)
+		if err := <-started; err != nil {
+			t.Errorf("Start returned error: %v", err)
+		}
+		log.SetOutput(os.Stderr)
+	})
+
+	e.Incoming <- CnxMgrMsg{Type: NEW_CONNECTION, ID: id}
+	send := func(command string, headers ...string) {
+		f := Frame{Command: command, Headers: map[string]string{}, Body: []byte{}}
+		for i := 0; i < len(headers); i += 2 {
+			f.Headers[headers[i]] = headers[i+1]
+		}
+		e.Incoming <- CnxMgrMsg{Type: FRAME, ID: id, Frame: f}
+	}
+	return client, send
+}
+
+func TestConnectAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users")
+	err = os.WriteFile(usersFile, []byte("alice:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewFileAuthenticator(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		login, passcode string
+		ok              bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"mallory", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run("_"+tt.login+"_"+tt.passcode, func(t *testing.T) {
+			cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+			e := NewEngine(&MemoryStore{Queues: map[string][][]Frame{}}, cm, cm.messages, 1, false, "", 0)
+			e.Auth = auth
+			client, send := startLoop(t, e, "client1")
+			fr := NewFrameReader(client)
+
+			send(CONNECT, "accept-version", "1.2", "login", tt.login, "passcode", tt.passcode)
+			f := readServerFrame(t, fr)
+			if tt.ok {
+				if f.Command != CONNECTED {
+					t.Fatalf("expected CONNECTED, got %+v", f)
+				}
+				// the CONNECTED frame is written after the session is updated
+				if p := e.sessions["client1"].Principal.Name; p != "alice" {
+					t.Errorf("got principal %q wanted alice", p)
+				}
+				return
+			}
+			if f.Command != ERROR {
+				t.Fatalf("expected ERROR, got %+v", f)
+			}
+			_, err := fr.ReadHeartbeat()
+			if err == nil {
+				t.Error("connection still open after failed login")
+			}
+		})
+	}
+}
+
+// slowAuthenticator holds up the login "slow" until release is closed
+type slowAuthenticator struct {
+	release chan struct{}
+}
+
+func (a slowAuthenticator) Authenticate(login, passcode string) (Principal, error) {
+	if login == "slow" {
+		<-a.release
+	}
+	return Principal{Name: login}, nil
+}
+
+func TestConnectAuthenticationSlow(t *testing.T) {
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/test": {}}}
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	auth := slowAuthenticator{release: make(chan struct{})}
+	e.Auth = auth
+	slow, sendSlow := startLoop(t, e, "slow")
+	slowFr := NewFrameReader(slow)
+
+	server, fast := net.Pipe()
+	defer fast.Close()
+	cm.mu.Lock()
+	cm.connections["fast"] = NewConnection(server, "fast", DefaultOutboundConfig)
+	cm.mu.Unlock()
+	e.Incoming <- CnxMgrMsg{Type: NEW_CONNECTION, ID: "fast"}
+	fastFr := NewFrameReader(fast)
+
+	// the slow client pipelines a SUBSCRIBE behind its CONNECT
+	sendSlow(CONNECT, "accept-version", "1.2", "login", "slow")
+	sendSlow(SUBSCRIBE, "id", "0", "destination", "/queue/test", "receipt", "sub")
+
+	// meanwhile another client connects and sends
+	for _, f := range []Frame{
+		{Command: CONNECT, Headers: map[string]string{"accept-version": "1.2", "login": "fast"}},
+		{Command: SEND, Headers: map[string]string{"destination": "/queue/test", "receipt": "send"}},
+	} {
+		f.Body = []byte{}
+		e.Incoming <- CnxMgrMsg{Type: FRAME, ID: "fast", Frame: f}
+	}
+	fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if f := readServerFrame(t, fastFr); f.Command != CONNECTED {
+		t.Fatalf("expected CONNECTED, got %+v", f)
+	}
+	if f := readServerFrame(t, fastFr); f.Command != RECEIPT || f.Headers["receipt-id"] != "send" {
+		t.Errorf("expected RECEIPT for the SEND, got %+v", f)
+	}
+
+	// once authenticated, the slow client is connected before its SUBSCRIBE is handled
+	close(auth.release)
+	for _, want := range []string{CONNECTED, RECEIPT, MESSAGE} {
+		if f := readServerFrame(t, slowFr); f.Command != want {
+			t.Errorf("expected %s, got %+v", want, f)
+		}
+	}
+}
+
+func TestEngineNoSendWorkers(t *testing.T) {
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	e := NewEngine(&MemoryStore{Queues: map[string][][]Frame{}}, cm, cm.messages, 0, false, "", 0)
+	err := e.Start()
+	if err == nil {
+		t.Error("started with no send workers")
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/test": {}}}
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	client, send := startLoop(t, e, "client1")
+	fr := NewFrameReader(client)
+
+	send(CONNECT, "accept-version", "1.2")
+	if f := readServerFrame(t, fr); f.Command != CONNECTED {
+		t.Fatalf("expected CONNECTED, got %+v", f)
+	}
+
+	tests := []struct {
+		command string
+		headers []string
+		reply   string
+	}{
+		{BEGIN, []string{"transaction", "tx1", "receipt", "1"}, RECEIPT},
+		{SEND, []string{"transaction", "tx1", "destination", "/queue/test", "receipt", "2"}, RECEIPT},
+		{COMMIT, []string{"transaction", "tx1", "receipt", "3"}, RECEIPT},
+		{BEGIN, []string{"transaction", "tx2", "receipt", "4"}, RECEIPT},
+		{ABORT, []string{"transaction", "tx2", "receipt", "5"}, RECEIPT},
+		{ABORT, []string{"transaction", "tx2", "receipt", "6"}, ERROR},
+		{SEND, []string{"destination", "/queue/none", "receipt", "7"}, ERROR},
+	}
+	for _, tt := range tests {
+		send(tt.command, tt.headers...)
+		f := readServerFrame(t, fr)
+		receiptID := tt.headers[len(tt.headers)-1]
+		if f.Command != tt.reply || f.Headers["receipt-id"] != receiptID {
+			t.Errorf("%s: expected %s with receipt-id %s, got %+v", tt.command, tt.reply, receiptID, f)
+		}
+	}
+	if n, _ := st.Len("/queue/test"); n != 1 {
+		t.Errorf("got %d messages stored wanted 1", n)
+	}
+}
+
+func TestSendHeaderInjection(t *testing.T) {
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/test": {}}}
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	client, send := startLoop(t, e, "producer")
+	fr := NewFrameReader(client)
+
+	// a STOMP 1.0 consumer, which cannot be sent an escaped line break
+	server, consumer := net.Pipe()
+	defer consumer.Close()
+	cm.mu.Lock()
+	cm.connections["consumer"] = NewConnection(server, "consumer", DefaultOutboundConfig)
+	cm.mu.Unlock()
+	cm.SetVersion("consumer", VERSION_1_0)
+	e.SM.Subscribe("consumer", "0", "/queue/test", ACK_AUTO)
+
+	send(CONNECT, "accept-version", "1.2")
+	if f := readServerFrame(t, fr); f.Command != CONNECTED {
+		t.Fatalf("expected CONNECTED, got %+v", f)
+	}
+
+	// headers as the 1.2 producer's frame parsed them, with its escapes decoded
+	for _, v := range []string{"a\nmessage-id:forged", "a\rb", "a\000b"} {
+		send(SEND, "destination", "/queue/test", "x-evil", v, "receipt", "1")
+		if f := readServerFrame(t, fr); f.Command != ERROR || f.Headers["receipt-id"] != "1" {
+			t.Errorf("SEND with header %q: expected ERROR, got %+v", v, f)
+		}
+	}
+	send(SEND, "destination", "/queue/test", "x-fine", "a:b", "receipt", "2")
+	if f := readServerFrame(t, fr); f.Command != RECEIPT {
+		t.Fatalf("expected RECEIPT, got %+v", f)
+	}
+
+	f := readServerFrame(t, NewFrameReader(consumer))
+	if f.Headers["x-fine"] != "a:b" || f.Headers["message-id"] == "forged" {
+		t.Errorf("1.0 consumer got headers %v", f.Headers)
+	}
+	if n, _ := st.Len("/queue/test"); n != 0 {
+		t.Errorf("got %d messages left in store wanted 0", n)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	cm := NewConnectionManager("", 0, make(chan CnxMgrMsg), 0)
+	st := &MemoryStore{Queues: map[string][][]Frame{"/queue/a": {}, "/queue/b": {}}}
+	e := NewEngine(st, cm, cm.messages, 1, false, "", 0)
+	acl, err := NewACL([]ACLRule{
+		{Users: []string{"bob"}, Destination: "/queue/a", Permissions: []string{PERM_READ, PERM_WRITE}},
+		{Users: []string{"bob"}, Destination: "/queue/b", Permissions: []string{PERM_WRITE}},
+		{Users: []string{"bob"}, Destination: "/queue/new/**", Permissions: []string{PERM_READ}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ACL = acl
+	client, send := startLoop(t, e, "client1")
+	fr := NewFrameReader(client)
+
+	send(CONNECT, "accept-version", "1.2", "login", "bob")
+	if f := readServerFrame(t, fr); f.Command != CONNECTED {
+		t.Fatalf("expected CONNECTED, got %+v", f)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		headers []string
+		reply   string
+	}{
+		{"send allowed", SEND, []string{"destination", "/queue/b"}, RECEIPT},
+		{"send denied", SEND, []string{"destination", "/queue/c"}, ERROR},
+		{"subscribe allowed", SUBSCRIBE, []string{"id", "0", "destination", "/queue/a"}, RECEIPT},
+		{"subscribe denied", SUBSCRIBE, []string{"id", "1", "destination", "/queue/b"}, ERROR},
+		{"create denied", SUBSCRIBE, []string{"id", "2", "destination", "/queue/new/x", "create", "true"}, ERROR},
+		{"begin", BEGIN, []string{"transaction", "tx1"}, RECEIPT},
+		{"send in transaction", SEND, []string{"transaction", "tx1", "destination", "/queue/b"}, RECEIPT},
+		{"denied send in transaction", SEND, []string{"transaction", "tx1", "destination", "/queue/c"}, RECEIPT},
+		{"commit denied", COMMIT, []string{"transaction", "tx1"}, ERROR},
+	}
+	for i, tt := range tests {
+		send(tt.command, append(tt.headers, "receipt", strconv.Itoa(i))...)
+		if f := readServerFrame(t, fr); f.Command != tt.reply {
+			t.Errorf("%s: expected %s, got %+v", tt.name, tt.reply, f)
+		}
+	}
+
+	if n := e.MS.GetDeniedCount(); n != 4 {
+		t.Errorf("got DeniedCount %d wanted 4", n)
+	}
+	// only the message sent outside the transaction is stored
+	if n, _ := st.Len("/queue/b"); n != 1 {
+		t.Errorf("got %d messages on /queue/b wanted 1", n)
+	}
+	if st.Prs("/queue/new/x") {
+		t.Error("destination created without create permission")
+	}
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// design notes:
+// * every mutation (new destination, enqueue, transaction, pop, requeue) is appended to the log as one record
+// * a record is [4 byte payload length][4 byte crc32 of payload][payload], so a torn write at the tail is detectable
+// * a transaction is a single record, which is what makes EnqueueTx all-or-nothing across a crash
+// * the log is split into segments; a new segment starts by re-declaring every destination
+//   so that older segments can be deleted once every message stored in them has been popped
+// * the in-memory index maps each destination to the on-disk location of its queued messages,
+//   so message bodies are only read back from disk when they are popped
+// * popping a message only takes it out of the index; its pop is logged when the engine acks it, once
+//   the client has acknowledged it or, in auto ack mode, once it has been handed to the connection.
+//   Messages in flight at a crash are therefore still queued when the log is replayed, and requeueing
+//   an in-flight message needs no record at all. A message without a message-id cannot be acked,
+//   so its pop is logged straight away.
+
+const (
+	opAddDestination = iota + 1
+	opEnqueue
+	opPop
+	opRequeue
+)
+
+const (
+	recordHeaderSize   = 8
+	segmentFileSuffix  = ".log"
+	DefaultSegmentSize = 64 * 1024 * 1024
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt log record")
+	errStoreClosed   = errors.New("store is closed")
+)
+
+type FileStore struct {
+	// Defines a durable queue store backed by an append-only segmented log
+	// Concurrency protected by sync.Mutex
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []*segment // oldest first, the last segment is the one being appended to
+	queues      map[string][]indexEntry
+	inflight    map[string]inflightEntry // popped but not yet acked, by message-id
+	nextSeq     uint64
+	notify      chan struct{}
+	closed      bool
+}
+
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+	live int // number of queued messages whose record lives in this segment
+}
+
+// indexEntry locates one queued message in the log
+type indexEntry struct {
+	seq     uint64
+	segment uint64
+	offset  int64
+}
+
+// inflightEntry is a message that has been popped but whose pop is not yet logged
+type inflightEntry struct {
+	destination string
+	entry       indexEntry
+}
+
+type logRecord struct {
+	op          byte
+	destination string     // opAddDestination and opPop
+	seq         uint64     // opPop
+	entries     []logEntry // opEnqueue and opRequeue
+}
+
+type logEntry struct {
+	seq         uint64
+	destination string
+	message     []Frame
+}
+
+// NewFileStore opens the log in dir, creating it if needed, and rebuilds the queues from it
+func NewFileStore(dir string, segmentSize int64) (*FileStore, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		dir:         dir,
+		segmentSize: segmentSize,
+		queues:      make(map[string][]indexEntry),
+		inflight:    make(map[string]inflightEntry),
+		nextSeq:     1,
+		notify:      make(chan struct{}, 1),
+	}
+
+	err = fs.recover()
+	if err != nil {
+		fs.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) Enqueue(destination string, message Frame) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if _, prs := fs.queues[destination]; !prs {
+		return errors.New("no such destination")
+	}
+
+	return fs.appendEntries(opEnqueue, []logEntry{{
+		seq:         fs.takeSeq(),
+		destination: destination,
+		message:     []Frame{message},
+	}})
+}
+
+func (fs *FileStore) EnqueueTx(tx []Frame) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	entries := make([]logEntry, 0, len(tx))
+	for _, v := range tx {
+		dest := v.Headers["destination"]
+		if _, prs := fs.queues[dest]; !prs {
+			return errors.New("bad destination for at least one frame")
+		}
+		entries = append(entries, logEntry{destination: dest, message: []Frame{v}})
+	}
+	for i := range entries {
+		entries[i].seq = fs.takeSeq()
+	}
+
+	return fs.appendEntries(opEnqueue, entries)
+}
+
+func (fs *FileStore) Pop(destination string) ([]Frame, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.closed {
+		return []Frame{}, errStoreClosed
+	}
+	q, prs := fs.queues[destination]
+	if !prs {
+		return []Frame{}, errors.New("no such destination")
+	}
+	if len(q) == 0 {
+		return []Frame{}, errors.New("destination queue empty")
+	}
+
+	head := q[0]
+	msg, err := fs.readMessage(head)
+	if err != nil {
+		return []Frame{}, err
+	}
+
+	id := ""
+	if len(msg) == 1 {
+		id = msg[0].Headers["message-id"]
+	}
+	if _, prs := fs.inflight[id]; id == "" || prs {
+		// a message that Ack could not tell apart is done with as soon as it is popped
+		err = fs.appendRecord(logRecord{op: opPop, destination: destination, seq: head.seq})
+		if err != nil {
+			return []Frame{}, err
+		}
+		fs.compactLogged()
+		return msg, nil
+	}
+
+	fs.queues[destination] = q[1:]
+	fs.inflight[id] = inflightEntry{destination: destination, entry: head}
+	return msg, nil
+}
+
+// Ack logs the pop of a message that Pop handed out, after which it is gone for good.
+// A message that is not in flight, because its pop was logged when it was popped or
+// because it has been requeued since, is left alone.
+func (fs *FileStore) Ack(destination string, message Frame) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.closed {
+		return errStoreClosed
+	}
+	id := message.Headers["message-id"]
+	f, prs := fs.inflight[id]
+	if !prs || f.destination != destination {
+		return nil
+	}
+
+	// the entry is no longer in the index, so applying the record leaves the segment count to us
+	err := fs.appendRecord(logRecord{op: opPop, destination: destination, seq: f.entry.seq})
+	if err != nil {
+		return err
+	}
+	delete(fs.inflight, id)
+	if seg := fs.segmentByID(f.entry.segment); seg != nil {
+		seg.live--
+	}
+	fs.compactLogged()
+	return nil
+}
+
+// compactLogged compacts the log, logging rather than returning an error, since the
+// operation that freed the space has already succeeded. Assumes fs is locked.
+func (fs *FileStore) compactLogged() {
+	err := fs.compact()
+	if err != nil {
+		log.Printf("FILE_STORE: compaction error: %v\n", err)
+	}
+}
+
+// Requeue puts a message back at the head of the destination queue
+func (fs *FileStore) Requeue(destination string, message Frame) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.closed {
+		return errStoreClosed
+	}
+	if _, prs := fs.queues[destination]; !prs {
+		return errors.New("no such destination")
+	}
+
+	id := message.Headers["message-id"]
+	if f, prs := fs.inflight[id]; prs && f.destination == destination {
+		// its pop was never logged, so the log still has it queued
+		delete(fs.inflight, id)
+		fs.queues[destination] = append([]indexEntry{f.entry}, fs.queues[destination]...)
+		signalAvailable(fs.notify)
+		return nil
+	}
+
+	return fs.appendEntries(opRequeue, []logEntry{{
+		seq:         fs.takeSeq(),
+		destination: destination,
+		message:     []Frame{message},
+	}})
+}
+
+func (fs *FileStore) AddDestination(destination string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if _, prs := fs.queues[destination]; prs {
+		return fmt.Errorf("destination %s already exists", destination)
+	}
+
+	return fs.appendRecord(logRecord{op: opAddDestination, destination: destination})
+}
+
+func (fs *FileStore) Prs(destination string) bool {
+	fs.Lock()
+	_, prs := fs.queues[destination]
+	fs.Unlock()
+	return prs
+}
+
+func (fs *FileStore) Len(destination string) (int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q, prs := fs.queues[destination]
+	if !prs {
+		return -1, errors.New("no such destination")
+	}
+
+	return len(q), nil
+}
+
+func (fs *FileStore) Destinations() []string {
+	fs.Lock()
+	defer fs.Unlock()
+	keys := make([]string, 0, len(fs.queues))
+	for k := range fs.queues {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (fs *FileStore) Notify() <-chan struct{} {
+	return fs.notify
+}
+
+// Close closes the log; any later call that would read or write it returns an error
+func (fs *FileStore) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	var firstErr error
+	for _, seg := range fs.segments {
+		err := seg.file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	fs.segments = nil
+	return firstErr
+}
+
+// takeSeq assumes fs is locked
+func (fs *FileStore) takeSeq() uint64 {
+	seq := fs.nextSeq
+	fs.nextSeq++
+	return seq
+}
+
+// appendEntries writes an enqueue or requeue record and indexes its entries. Assumes fs is locked.
+func (fs *FileStore) appendEntries(op byte, entries []logEntry) error {
+	err := fs.appendRecord(logRecord{op: op, entries: entries})
+	if err == nil {
+		signalAvailable(fs.notify)
+	}
+	return err
+}
+
+// appendRecord writes one record to the active segment, rolling to a new segment
+// first if the active one is full, then applies it to the index. Assumes fs is locked.
+func (fs *FileStore) appendRecord(rec logRecord) error {
+	if fs.closed {
+		return errStoreClosed
+	}
+	active := fs.segments[len(fs.segments)-1]
+	if active.size >= fs.segmentSize {
+		var err error
+		active, err = fs.roll()
+		if err != nil {
+			return err
+		}
+	}
+
+	offset, err := writeRecord(active, rec)
+	if err != nil {
+		return err
+	}
+	fs.apply(rec, active, offset)
+	return nil
+}
+
+// roll starts a new segment that re-declares every destination. Assumes fs is locked.
+func (fs *FileStore) roll() (*segment, error) {
+	prev := fs.segments[len(fs.segments)-1]
+	seg, err := fs.openSegment(prev.id + 1)
+	if err != nil {
+		return nil, err
+	}
+	fs.segments = append(fs.segments, seg)
+
+	for dest := range fs.queues {
+		_, err := writeRecord(seg, logRecord{op: opAddDestination, destination: dest})
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("FILE_STORE: rolled to segment %d\n", seg.id)
+	return seg, nil
+}
+
+// compact deletes the oldest segments once they hold no queued messages.
+// Only a prefix of the log may be removed, otherwise pop records for messages in
+// older segments would be lost and those messages resurrected on recovery.
+func (fs *FileStore) compact() error {
+	for len(fs.segments) > 1 && fs.segments[0].live == 0 {
+		seg := fs.segments[0]
+		err := seg.file.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(seg.file.Name())
+		if err != nil {
+			return err
+		}
+		fs.segments = fs.segments[1:]
+		log.Printf("FILE_STORE: removed segment %d\n", seg.id)
+	}
+	return nil
+}
+
+// apply updates the index for one record located at offset in seg. Assumes fs is locked.
+func (fs *FileStore) apply(rec logRecord, seg *segment, offset int64) {
+	switch rec.op {
+	case opAddDestination:
+		if _, prs := fs.queues[rec.destination]; !prs {
+			fs.queues[rec.destination] = make([]indexEntry, 0)
+		}
+	case opEnqueue:
+		for _, e := range rec.entries {
+			fs.queues[e.destination] = append(fs.queues[e.destination], indexEntry{seq: e.seq, segment: seg.id, offset: offset})
+			seg.live++
+		}
+	case opRequeue:
+		for _, e := range rec.entries {
+			entry := indexEntry{seq: e.seq, segment: seg.id, offset: offset}
+			fs.queues[e.destination] = append([]indexEntry{entry}, fs.queues[e.destination]...)
+			seg.live++
+		}
+	case opPop:
+		q := fs.queues[rec.destination]
+		for i := range q {
+			if q[i].seq == rec.seq {
+				if s := fs.segmentByID(q[i].segment); s != nil {
+					s.live--
+				}
+				fs.queues[rec.destination] = append(q[:i:i], q[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for _, e := range rec.entries {
+		if e.seq >= fs.nextSeq {
+			fs.nextSeq = e.seq + 1
+		}
+	}
+}
+
+// readMessage reads the frames for one queued message back from its segment. Assumes fs is locked.
+func (fs *FileStore) readMessage(entry indexEntry) ([]Frame, error) {
+	seg := fs.segmentByID(entry.segment)
+	if seg == nil {
+		return nil, fmt.Errorf("segment %d for message %d missing", entry.segment, entry.seq)
+	}
+
+	head := make([]byte, recordHeaderSize)
+	_, err := seg.file.ReadAt(head, entry.offset)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head[0:4]))
+	_, err = seg.file.ReadAt(payload, entry.offset+recordHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:8]) {
+		return nil, errCorruptRecord
+	}
+
+	rec, err := decodeRecord(payload)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range rec.entries {
+		if e.seq == entry.seq {
+			return e.message, nil
+		}
+	}
+	return nil, fmt.Errorf("message %d not found in its record", entry.seq)
+}
+
+func (fs *FileStore) segmentByID(id uint64) *segment {
+	for _, seg := range fs.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// recover replays every segment in order to rebuild the index.
+// A torn record at the end of the newest segment is truncated away; corruption anywhere else is an error.
+func (fs *FileStore) recover() error {
+	ids, err := fs.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		seg, err := fs.openSegment(id)
+		if err != nil {
+			return err
+		}
+		fs.segments = append(fs.segments, seg)
+
+		last := i == len(ids)-1
+		err = fs.replay(seg, last)
+		if err != nil {
+			return fmt.Errorf("segment %d: %v", id, err)
+		}
+	}
+
+	if len(fs.segments) == 0 {
+		seg, err := fs.openSegment(1)
+		if err != nil {
+			return err
+		}
+		fs.segments = append(fs.segments, seg)
+	}
+
+	messages := 0
+	for _, q := range fs.queues {
+		messages += len(q)
+	}
+	log.Printf("FILE_STORE: recovered %d destinations and %d messages from %d segments in %s\n", len(fs.queues), messages, len(fs.segments), fs.dir)
+	return nil
+}
+
+func (fs *FileStore) replay(seg *segment, last bool) error {
+	_, err := seg.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(seg.file)
+	var offset int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !last {
+				return err
+			}
+			log.Printf("FILE_STORE: truncating segment %d at offset %d: %v\n", seg.id, offset, err)
+			err = seg.file.Truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		fs.apply(rec, seg, offset)
+		offset += n
+	}
+	seg.size = offset
+	return nil
+}
+
+func (fs *FileStore) segmentIDs() ([]uint64, error) {
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (fs *FileStore) openSegment(id uint64) (*segment, error) {
+	name := filepath.Join(fs.dir, fmt.Sprintf("%020d%s", id, segmentFileSuffix))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &segment{id: id, file: f, size: info.Size()}, nil
+}
+
+// writeRecord appends rec to seg and syncs it to disk, returning the offset it was written at
+func writeRecord(seg *segment, rec logRecord) (int64, error) {
+	payload := encodeRecord(rec)
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	offset := seg.size
+	_, err := seg.file.Write(buf)
+	if err != nil {
+		// drop any partial write so the next record starts on a clean boundary
+		seg.file.Truncate(offset)
+		return 0, err
+	}
+	err = seg.file.Sync()
+	if err != nil {
+		// the record may or may not be on disk, so it is dropped like a failed write
+		seg.file.Truncate(offset)
+		return 0, err
+	}
+	seg.size += int64(len(buf))
+	return offset, nil
+}
+
+// readRecord reads the next record and returns its total size on disk.
+// io.EOF is only returned at a clean record boundary.
+func readRecord(r io.Reader) (logRecord, int64, error) {
+	head := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, head)
+	if err == io.ErrUnexpectedEOF {
+		return logRecord{}, 0, errors.New("truncated record header")
+	}
+	if err != nil {
+		return logRecord{}, 0, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(head[0:4]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return logRecord{}, 0, errors.New("truncated record payload")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:8]) {
+		return logRecord{}, 0, errCorruptRecord
+	}
+
+	rec, err := decodeRecord(payload)
+	return rec, int64(recordHeaderSize + len(payload)), err
+}
+
+// record payload encoding: an op byte followed by uvarint-length-prefixed fields
+
+func encodeRecord(rec logRecord) []byte {
+	enc := &recordEncoder{}
+	enc.buf = append(enc.buf, rec.op)
+	switch rec.op {
+	case opAddDestination:
+		enc.string(rec.destination)
+	case opPop:
+		enc.string(rec.destination)
+		enc.uvarint(rec.seq)
+	case opEnqueue, opRequeue:
+		enc.uvarint(uint64(len(rec.entries)))
+		for _, e := range rec.entries {
+			enc.uvarint(e.seq)
+			enc.string(e.destination)
+			enc.uvarint(uint64(len(e.message)))
+			for _, f := range e.message {
+				enc.frame(f)
+			}
+		}
+	}
+	return enc.buf
+}
+
+func decodeRecord(payload []byte) (logRecord, error) {
+	if len(payload) == 0 {
+		return logRecord{}, errCorruptRecord
+	}
+	dec := &recordDecoder{buf: payload[1:]}
+	rec := logRecord{op: payload[0]}
+	switch rec.op {
+	case opAddDestination:
+		rec.destination = dec.string()
+	case opPop:
+		rec.destination = dec.string()
+		rec.seq = dec.uvarint()
+	case opEnqueue, opRequeue:
+		n := dec.uvarint()
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			e := logEntry{seq: dec.uvarint(), destination: dec.string()}
+			m := dec.uvarint()
+			for j := uint64(0); j < m && dec.err == nil; j++ {
+				e.message = append(e.message, dec.frame())
+			}
+			rec.entries = append(rec.entries, e)
+		}
+	default:
+		return logRecord{}, fmt.Errorf("unknown log op %d", rec.op)
+	}
+	return rec, dec.err
+}
+
+type recordEncoder struct {
+	buf []byte
+}
+
+func (enc *recordEncoder) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	enc.buf = append(enc.buf, tmp[:n]...)
+}
+
+func (enc *recordEncoder) string(s string) {
+	enc.uvarint(uint64(len(s)))
+	enc.buf = append(enc.buf, s...)
+}
+
+func (enc *recordEncoder) bytes(b []byte) {
+	enc.uvarint(uint64(len(b)))
+	enc.buf = append(enc.buf, b...)
+}
+
+func (enc *recordEncoder) frame(f Frame) {
+	enc.string(f.Command)
+	enc.uvarint(uint64(len(f.Headers)))
+	for k, v := range f.Headers {
+		enc.string(k)
+		enc.string(v)
+	}
+	enc.bytes(f.Body)
+}
+
+type recordDecoder struct {
+	buf []byte
+	err error
+}
+
+func (dec *recordDecoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(dec.buf)
+	if n <= 0 {
+		dec.err = errCorruptRecord
+		return 0
+	}
+	dec.buf = dec.buf[n:]
+	return v
+}
+
+func (dec *recordDecoder) string() string {
+	return string(dec.bytes())
+}
+
+// bytes returns a copy, so decoded frames do not alias the record buffer
+func (dec *recordDecoder) bytes() []byte {
+	n := dec.uvarint()
+	if dec.err != nil {
+		return []byte{}
+	}
+	if uint64(len(dec.buf)) < n {
+		dec.err = errCorruptRecord
+		return []byte{}
+	}
+	b := make([]byte, n)
+	copy(b, dec.buf[:n])
+	dec.buf = dec.buf[n:]
+	return b
+}
+
+func (dec *recordDecoder) frame() Frame {
+	f := Frame{Command: dec.string(), Headers: make(map[string]string)}
+	n := dec.uvarint()
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		k := dec.string()
+		f.Headers[k] = dec.string()
+	}
+	f.Body = dec.bytes()
+	return f
+}
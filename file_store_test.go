@@ -0,0 +1,296 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	first := Frame{Command: "MESSAGE", Headers: map[string]string{"destination": "/queue/test", "message-id": "1"}, Body: []byte("first")}
+	second := Frame{Command: "MESSAGE", Headers: map[string]string{"destination": "/queue/test", "message-id": "2"}, Body: []byte("second\000binary")}
+	requeued := Frame{Command: "MESSAGE", Headers: map[string]string{"destination": "/queue/test", "message-id": "0"}, Body: []byte("requeued")}
+
+	fs, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("open error: ", err)
+	}
+	err = fs.AddDestination("/queue/test")
+	if err != nil {
+		t.Error("destination add error: ", err)
+	}
+	err = fs.AddDestination("/queue/test")
+	if err == nil {
+		t.Error("allowed duplicate destination creation")
+	}
+	err = fs.Enqueue("/queue/none", first)
+	if err == nil {
+		t.Error("allowed enqueue to nonexistent destination")
+	}
+	for _, fr := range []Frame{first, second, first} {
+		err = fs.Enqueue("/queue/test", fr)
+		if err != nil {
+			t.Error("enqueue error: ", err)
+		}
+	}
+	popped, err := fs.Pop("/queue/test")
+	if err != nil {
+		t.Fatal("pop error: ", err)
+	}
+	err = fs.Ack("/queue/test", popped[0])
+	if err != nil {
+		t.Error("ack error: ", err)
+	}
+	err = fs.Requeue("/queue/test", requeued)
+	if err != nil {
+		t.Error("requeue error: ", err)
+	}
+	fs.Close()
+
+	fs, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("reopen error: ", err)
+	}
+	defer fs.Close()
+
+	if !fs.Prs("/queue/test") {
+		t.Fatal("destination not recovered")
+	}
+	l, _ := fs.Len("/queue/test")
+	if l != 3 {
+		t.Fatalf("wrong recovered length: got %d wanted 3", l)
+	}
+	for _, want := range []Frame{requeued, second, first} {
+		got, err := fs.Pop("/queue/test")
+		if err != nil {
+			t.Error("pop error: ", err)
+		} else if !reflect.DeepEqual(got, []Frame{want}) {
+			t.Errorf("got %+v / wanted %+v\n", got, want)
+		}
+	}
+	_, err = fs.Pop("/queue/test")
+	if err == nil {
+		t.Error("expected error popping empty queue")
+	}
+}
+
+func TestFileStoreInflight(t *testing.T) {
+	dir := t.TempDir()
+	frame := func(id string) Frame {
+		return Frame{Command: "MESSAGE", Headers: map[string]string{"destination": "/queue/test", "message-id": id}, Body: []byte("body " + id)}
+	}
+
+	fs, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("open error: ", err)
+	}
+	fs.AddDestination("/queue/test")
+	for _, id := range []string{"a", "b", "c"} {
+		fs.Enqueue("/queue/test", frame(id))
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		got, err := fs.Pop("/queue/test")
+		if err != nil {
+			t.Fatal("pop error: ", err)
+		}
+		if !reflect.DeepEqual(got, []Frame{frame(id)}) {
+			t.Errorf("got %+v / wanted %+v\n", got, frame(id))
+		}
+	}
+	// a is acknowledged, b is handed back and c is never settled
+	fs.Ack("/queue/test", frame("a"))
+	err = fs.Requeue("/queue/test", frame("b"))
+	if err != nil {
+		t.Error("requeue error: ", err)
+	}
+	if l, _ := fs.Len("/queue/test"); l != 1 {
+		t.Errorf("wrong length before restart: got %d wanted 1", l)
+	}
+	fs.Close()
+
+	fs, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("reopen error: ", err)
+	}
+	defer fs.Close()
+	if l, _ := fs.Len("/queue/test"); l != 2 {
+		t.Fatalf("wrong recovered length: got %d wanted 2", l)
+	}
+	for _, id := range []string{"b", "c"} {
+		got, err := fs.Pop("/queue/test")
+		if err != nil {
+			t.Error("pop error: ", err)
+		} else if !reflect.DeepEqual(got, []Frame{frame(id)}) {
+			t.Errorf("got %+v / wanted %+v\n", got, frame(id))
+		}
+	}
+}
+
+func TestFileStoreEnqueueTx(t *testing.T) {
+	dir := t.TempDir()
+	frameTo := func(dest, body string) Frame {
+		return Frame{Command: "MESSAGE", Headers: map[string]string{"destination": dest}, Body: []byte(body)}
+	}
+
+	fs, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("open error: ", err)
+	}
+	fs.AddDestination("/queue/a")
+	fs.AddDestination("/queue/b")
+
+	err = fs.EnqueueTx([]Frame{frameTo("/queue/a", "tx"), frameTo("/queue/none", "tx")})
+	if err == nil {
+		t.Error("allowed transaction with a bad destination")
+	}
+	if l, _ := fs.Len("/queue/a"); l != 0 {
+		t.Errorf("failed transaction partially applied: /queue/a has %d messages", l)
+	}
+
+	tx := []Frame{frameTo("/queue/a", "1"), frameTo("/queue/b", "2"), frameTo("/queue/a", "3")}
+	err = fs.EnqueueTx(tx)
+	if err != nil {
+		t.Error("transaction error: ", err)
+	}
+	fs.Close()
+
+	fs, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("reopen error: ", err)
+	}
+	defer fs.Close()
+	for _, want := range []struct {
+		dest  string
+		frame Frame
+	}{{"/queue/a", tx[0]}, {"/queue/a", tx[2]}, {"/queue/b", tx[1]}} {
+		got, err := fs.Pop(want.dest)
+		if err != nil {
+			t.Errorf("pop error on %s: %v", want.dest, err)
+		} else if !reflect.DeepEqual(got, []Frame{want.frame}) {
+			t.Errorf("got %+v / wanted %+v\n", got, want.frame)
+		}
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	fr := Frame{Command: "MESSAGE", Headers: map[string]string{}, Body: []byte("body")}
+
+	fs, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("open error: ", err)
+	}
+	fs.AddDestination("/queue/test")
+	fs.Enqueue("/queue/test", fr)
+	fs.Enqueue("/queue/test", fr)
+	name := fs.segments[0].file.Name()
+	size := fs.segments[0].size
+	fs.Close()
+
+	// simulate a crash part way through writing the second message
+	err = os.Truncate(name, size-3)
+	if err != nil {
+		t.Fatal("truncate error: ", err)
+	}
+
+	fs, err = NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal("reopen error: ", err)
+	}
+	defer fs.Close()
+	if l, _ := fs.Len("/queue/test"); l != 1 {
+		t.Errorf("wrong recovered length: got %d wanted 1", l)
+	}
+
+	// the store should keep appending cleanly after the truncated record
+	err = fs.Enqueue("/queue/test", fr)
+	if err != nil {
+		t.Error("enqueue error: ", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := fs.Pop("/queue/test")
+		if err != nil {
+			t.Error("pop error: ", err)
+		}
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	fr := Frame{Command: "MESSAGE", Headers: map[string]string{}, Body: []byte("a body long enough to fill small segments")}
+
+	fs, err := NewFileStore(dir, 128)
+	if err != nil {
+		t.Fatal("open error: ", err)
+	}
+	fs.AddDestination("/queue/test")
+	for i := 0; i < 10; i++ {
+		err := fs.Enqueue("/queue/test", fr)
+		if err != nil {
+			t.Error("enqueue error: ", err)
+		}
+	}
+	if len(fs.segments) < 3 {
+		t.Fatalf("expected the log to roll over: got %d segments", len(fs.segments))
+	}
+	for i := 0; i < 9; i++ {
+		_, err := fs.Pop("/queue/test")
+		if err != nil {
+			t.Error("pop error: ", err)
+		}
+	}
+	fs.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentFileSuffix))
+	if len(files) > 3 {
+		t.Errorf("consumed segments not removed: %d segment files remain", len(files))
+	}
+
+	fs, err = NewFileStore(dir, 128)
+	if err != nil {
+		t.Fatal("reopen error: ", err)
+	}
+	defer fs.Close()
+	if !fs.Prs("/queue/test") {
+		t.Error("destination lost after compaction")
+	}
+	if l, _ := fs.Len("/queue/test"); l != 1 {
+		t.Errorf("wrong recovered length: got %d wanted 1", l)
+	}
+}
+
+func TestFileStoreClosed(t *testing.T) {
+	fr := Frame{Command: "MESSAGE", Headers: map[string]string{"destination": "/queue/test"}, Body: []byte("body")}
+	fs, err := NewFileStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal("open error: ", err)
+	}
+	fs.AddDestination("/queue/test")
+	fs.Enqueue("/queue/test", fr)
+	err = fs.Close()
+	if err != nil {
+		t.Fatal("close error: ", err)
+	}
+
+	calls := map[string]func() error{
+		"Enqueue":        func() error { return fs.Enqueue("/queue/test", fr) },
+		"EnqueueTx":      func() error { return fs.EnqueueTx([]Frame{fr}) },
+		"Requeue":        func() error { return fs.Requeue("/queue/test", fr) },
+		"AddDestination": func() error { return fs.AddDestination("/queue/new") },
+		"Pop":            func() error { _, err := fs.Pop("/queue/test"); return err },
+		"Ack":            func() error { return fs.Ack("/queue/test", fr) },
+		"Close":          func() error { return fs.Close() },
+	}
+	for name, call := range calls {
+		err := call()
+		if name == "Close" {
+			if err != nil {
+				t.Errorf("second Close returned %v", err)
+			}
+		} else if err != errStoreClosed {
+			t.Errorf("%s after Close: got %v wanted %v", name, err, errStoreClosed)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,96 +29,280 @@ const (
 	ERROR       = "ERROR"
 )
 
+const (
+	VERSION_1_0 = "1.0"
+	VERSION_1_1 = "1.1"
+	VERSION_1_2 = "1.2"
+)
+
+// supportedVersions is ordered from lowest to highest
+var supportedVersions = []string{VERSION_1_0, VERSION_1_1, VERSION_1_2}
+
+// negotiateVersion picks the highest protocol version that both the server and
+// a client's accept-version header support. A missing header means the client speaks 1.0.
+func negotiateVersion(acceptVersion string) (string, error) {
+	if acceptVersion == "" {
+		return VERSION_1_0, nil
+	}
+
+	accepted := make(map[string]bool)
+	for _, v := range strings.Split(acceptVersion, ",") {
+		accepted[strings.TrimSpace(v)] = true
+	}
+	for i := len(supportedVersions) - 1; i >= 0; i-- {
+		if accepted[supportedVersions[i]] {
+			return supportedVersions[i], nil
+		}
+	}
+	return "", fmt.Errorf("no supported protocol version in accept-version %s", acceptVersion)
+}
+
+// negotiateHeartbeat combines a client's heart-beat header with how often the server can send
+// heartbeats and how often it wants to receive them, returning the interval for each direction.
+// Per the specification each direction uses the larger of the two sides' values, or is disabled if either side is 0.
+func negotiateHeartbeat(header string, canSend, wantReceive time.Duration) (time.Duration, time.Duration, error) {
+	if header == "" {
+		return 0, 0, nil
+	}
+
+	tokens := strings.Split(header, ",")
+	if len(tokens) != 2 {
+		return 0, 0, fmt.Errorf("malformed heart-beat header %s", header)
+	}
+	cx, err := strconv.Atoi(strings.TrimSpace(tokens[0]))
+	if err != nil || cx < 0 {
+		return 0, 0, fmt.Errorf("malformed heart-beat header %s", header)
+	}
+	cy, err := strconv.Atoi(strings.TrimSpace(tokens[1]))
+	if err != nil || cy < 0 {
+		return 0, 0, fmt.Errorf("malformed heart-beat header %s", header)
+	}
+	clientSends := time.Duration(cx) * time.Millisecond
+	clientWants := time.Duration(cy) * time.Millisecond
+
+	var outgoing, incoming time.Duration
+	if canSend > 0 && clientWants > 0 {
+		outgoing = canSend
+		if clientWants > outgoing {
+			outgoing = clientWants
+		}
+	}
+	if wantReceive > 0 && clientSends > 0 {
+		incoming = wantReceive
+		if clientSends > incoming {
+			incoming = clientSends
+		}
+	}
+	return outgoing, incoming, nil
+}
+
 type Frame struct {
 	Command string
 	Headers map[string]string
-	Body    string
+	Body    []byte
 }
 
+// ParseFrame parses a frame using STOMP 1.2 header escaping rules
 func ParseFrame(text string) (Frame, error) {
-	tokens := strings.Split(text, "\n")
-	if len(tokens) < 3 {
-		return Frame{}, errors.New("invalid frame, too few newlines per STOMP specification")
+	return ParseFrameVersion(text, VERSION_1_2)
+}
+
+// ParseFrameVersion parses a frame sent on a connection that negotiated version
+// so that its header escapes are decoded according to that version
+func ParseFrameVersion(text string, version string) (Frame, error) {
+	return NewFrameReader(strings.NewReader(text)).ReadFrame(version)
+}
+
+// maxLineLength bounds a command or header line so a peer cannot make us buffer without limit
+const maxLineLength = 64 * 1024
+
+// DefaultMaxBodySize is the largest frame body a FrameReader accepts unless told otherwise
+const DefaultMaxBodySize = 16 * 1024 * 1024
+
+// FrameReader parses frames incrementally from a stream, such as a client connection.
+// Bodies are read according to their content-length header when present, so bodies
+// may contain NUL bytes. A body larger than the reader's limit is a parse error,
+// found before the body is buffered.
+type FrameReader struct {
+	r           *bufio.Reader
+	maxBodySize int
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r:           bufio.NewReader(r),
+		maxBodySize: DefaultMaxBodySize,
 	}
+}
 
-	// first line should be the command
-	command := tokens[0]
+// SetMaxBodySize sets the largest body, in bytes, that ReadFrame accepts
+func (fr *FrameReader) SetMaxBodySize(n int) {
+	fr.maxBodySize = n
+}
+
+// ReadHeartbeat consumes one heartbeat EOL (\n or \r\n) if that is what comes next in the stream.
+// It returns false without consuming anything if the next byte starts a frame.
+func (fr *FrameReader) ReadHeartbeat() (bool, error) {
+	b, err := fr.r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	switch b[0] {
+	case '\n':
+		fr.r.Discard(1)
+		return true, nil
+	case '\r':
+		b, err = fr.r.Peek(2)
+		if err != nil {
+			return false, err
+		}
+		if b[1] == '\n' {
+			fr.r.Discard(2)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReadFrame reads the next frame, skipping any heartbeat EOLs before it.
+// io.EOF is only returned if the stream ends cleanly between frames.
+func (fr *FrameReader) ReadFrame(version string) (Frame, error) {
+	for {
+		hb, err := fr.ReadHeartbeat()
+		if err != nil {
+			return Frame{}, err
+		}
+		if !hb {
+			break
+		}
+	}
 
+	// first line should be the command
+	command, err := fr.readLine()
+	if err != nil {
+		return Frame{}, fmt.Errorf("reading command: %w", unexpectedEOF(err))
+	}
 	if !validateCommand(command) {
-		return Frame{}, errors.New("invalid command")
+		return Frame{}, fmt.Errorf("invalid command %q", command)
 	}
 
 	// an arbitrary number of lines will be headers
-	// terminated by a blank line due to double \n characters
-	current := 1
-	stillHeaders := true
+	// terminated by a blank line
+	escaped := escapesHeaders(command, version)
 	headers := make(map[string]string)
-
-	for stillHeaders {
-		// test if we have reached a blank line signifying the end of the headers
-		if len(tokens[current]) > 0 {
-			k, v, err := parseHeader(tokens[current])
-			if err != nil {
-				return Frame{}, err
-			}
-			_, prs := headers[k] // if there is a duplicate header, drop each occurance after the first
-			if !prs {
-				headers[k] = v
-			}
-			current++
-		} else {
-			current++
-			stillHeaders = false
+	for lineNum := 1; ; lineNum++ {
+		line, err := fr.readLine()
+		if err != nil {
+			return Frame{}, fmt.Errorf("%s frame: reading header line %d: %w", command, lineNum, unexpectedEOF(err))
+		}
+		if len(line) == 0 {
+			break
+		}
+		k, v, err := parseHeader(line, version, escaped)
+		if err != nil {
+			return Frame{}, fmt.Errorf("%s frame: header line %d: %w", command, lineNum, err)
+		}
+		_, prs := headers[k] // if there is a duplicate header, drop each occurance after the first
+		if !prs {
+			headers[k] = v
 		}
 	}
 
-	possibleBody := strings.Join(tokens[current:], "\n")
-	cl, prs := headers["content-length"]
-	contentLength := -1
-	var errConv error
-	if prs {
-		contentLength, errConv = strconv.Atoi(cl)
-		if errConv != nil {
-			return Frame{}, errConv
-		}
-	}
-
-	if prs && contentLength >= 0 {
-		// if we have a content-length header with value greater than 0,
-		// we want to ensure we received the full header
-		// so we check against len(possibleBody) - 1 to count out a potential null byte
-		// required for termination
-		if (len(possibleBody) - 1) < contentLength {
-			return Frame{}, errors.New("incomplete frame")
-		}
-		// now that we know we have a long enough frame body
-		// we can slice it at content-length
-		// and check that it was null terminated / not too long
-		rest := []byte(possibleBody[contentLength:])
-		if len(rest) == 0 || rest[0] != '\000' {
-			return Frame{}, errors.New("termination error")
-		}
-		possibleBody = possibleBody[:contentLength]
-	} else {
-		// if we have no content-length header
-		// we need to ensure there is a null byte
-		byteBody := []byte(possibleBody)
-		terminatorIndex := bytes.IndexRune(byteBody, '\000')
-		if terminatorIndex < 0 {
-			return Frame{}, errors.New("termination error")
-		} else {
-			// and if there was, slice the body at the first null byte
-			possibleBody = possibleBody[:terminatorIndex]
-		}
+	body, err := fr.readBody(headers)
+	if err != nil {
+		return Frame{}, fmt.Errorf("%s frame: %w", command, err)
 	}
 
 	return Frame{
 		Command: command,
 		Headers: headers,
-		Body:    possibleBody,
+		Body:    body,
 	}, nil
 }
 
+// readBody reads the body and its NUL terminator, using content-length when the frame has one
+func (fr *FrameReader) readBody(headers map[string]string) ([]byte, error) {
+	cl, prs := headers["content-length"]
+	if !prs {
+		return fr.readToNUL()
+	}
+
+	contentLength, err := strconv.Atoi(cl)
+	if err != nil || contentLength < 0 {
+		return nil, fmt.Errorf("invalid content-length %q", cl)
+	}
+	if contentLength > fr.maxBodySize {
+		return nil, fmt.Errorf("content-length %d is larger than the maximum body size %d", contentLength, fr.maxBodySize)
+	}
+	body := make([]byte, contentLength)
+	_, err = io.ReadFull(fr.r, body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: got fewer than content-length %d bytes: %w", contentLength, unexpectedEOF(err))
+	}
+	terminator, err := fr.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("reading body: no NUL terminator: %w", unexpectedEOF(err))
+	}
+	if terminator != '\000' {
+		return nil, fmt.Errorf("body longer than content-length %d: expected NUL terminator", contentLength)
+	}
+	return body, nil
+}
+
+// readToNUL reads a body with no content-length, up to and without its NUL terminator,
+// giving up once it is larger than the maximum body size
+func (fr *FrameReader) readToNUL() ([]byte, error) {
+	var body []byte
+	for {
+		chunk, err := fr.r.ReadSlice('\000')
+		if len(body)+len(chunk) > fr.maxBodySize+1 {
+			return nil, fmt.Errorf("body larger than the maximum body size %d", fr.maxBodySize)
+		}
+		body = append(body, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading body: no NUL terminator: %w", unexpectedEOF(err))
+		}
+		return body[:len(body)-1], nil
+	}
+}
+
+// readLine reads one line without its \n or \r\n ending
+func (fr *FrameReader) readLine() (string, error) {
+	var acc []byte
+	for {
+		chunk, err := fr.r.ReadSlice('\n')
+		if len(acc)+len(chunk) > maxLineLength {
+			return "", fmt.Errorf("line longer than %d bytes", maxLineLength)
+		}
+		if err == bufio.ErrBufferFull {
+			acc = append(acc, chunk...)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if acc != nil {
+			chunk = append(acc, chunk...)
+		}
+		chunk = chunk[:len(chunk)-1]
+		if len(chunk) > 0 && chunk[len(chunk)-1] == '\r' {
+			chunk = chunk[:len(chunk)-1]
+		}
+		return string(chunk), nil
+	}
+}
+
+// once a frame has started, running out of input is never a clean EOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func validateCommand(cmd string) bool {
 	switch cmd {
 	case CONNECT, STOMP, CONNECTED, SEND, SUBSCRIBE, UNSUBSCRIBE, ACK,
@@ -125,30 +313,156 @@ func validateCommand(cmd string) bool {
 	}
 }
 
-func parseHeader(header string) (string, string, error) {
+func parseHeader(header string, version string, escaped bool) (string, string, error) {
 	// parse one header line into a key and a vlue
 	tokens := strings.SplitN(header, ":", 2) // only want to split on the first :
 	if len(tokens) != 2 {
 		return "", "", errors.New("malformed header")
 	}
-	return tokens[0], tokens[1], nil
+	if !escaped {
+		return tokens[0], tokens[1], nil
+	}
+
+	k, err := unescapeHeader(tokens[0], version)
+	if err != nil {
+		return "", "", err
+	}
+	v, err := unescapeHeader(tokens[1], version)
+	if err != nil {
+		return "", "", err
+	}
+	return k, v, nil
 }
 
-func UnmarshalFrame(frame Frame) string {
-	acc := frame.Command + "\n"
-	if len(frame.Headers) == 0 {
-		acc = acc + "\n"
-	} else {
-		for k, v := range frame.Headers {
-			acc = acc + k + ":" + v + "\n"
+// escapesHeaders reports whether header keys and values are escaped for a frame.
+// STOMP 1.0 has no escaping, and CONNECT and CONNECTED frames are never escaped
+// so that they can be read before a version has been negotiated.
+func escapesHeaders(command string, version string) bool {
+	if command == CONNECT || command == CONNECTED {
+		return false
+	}
+	return version != VERSION_1_0
+}
+
+// unescapeHeader decodes the escape sequences defined for version.
+// Any other escape sequence is a fatal protocol error per the specification.
+func unescapeHeader(s string, version string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errors.New("header ends in an incomplete escape sequence")
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		case 'r':
+			if version == VERSION_1_1 {
+				return "", errors.New("undefined escape sequence \\r in STOMP 1.1 header")
+			}
+			b.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("undefined escape sequence \\%c in header", s[i])
 		}
-		acc = acc + "\n"
 	}
+	return b.String(), nil
+}
 
-	if len(frame.Body) > 0 {
-		acc = acc + frame.Body + "\000"
-	} else {
-		acc = acc + "\000"
+// escapeHeader encodes a header key or value for version, the inverse of unescapeHeader
+func escapeHeader(s string, version string) string {
+	if !strings.ContainsAny(s, "\\\r\n:") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			b.WriteString("\\\\")
+		case '\n':
+			b.WriteString("\\n")
+		case ':':
+			b.WriteString("\\c")
+		case '\r':
+			if version == VERSION_1_1 {
+				// 1.1 cannot represent a carriage return, so it is sent as is
+				b.WriteByte('\r')
+			} else {
+				b.WriteString("\\r")
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// validateHeaders rejects header keys and values, as parsed, that some client could not be sent:
+// a NUL ends a frame for many parsers, and STOMP 1.0 has no way to escape a line break
+func validateHeaders(headers map[string]string) error {
+	for k, v := range headers {
+		if strings.ContainsAny(k, "\x00\r\n") || strings.ContainsAny(v, "\x00\r\n") {
+			return fmt.Errorf("header %q contains a NUL, carriage return or line feed", k)
+		}
 	}
-	return acc
+	return nil
+}
+
+// writableHeader reports whether a header can be written without changing the frame's meaning.
+// A NUL never can, and without escaping neither can a line break, or a colon in the key.
+func writableHeader(k, v string, escaped bool) bool {
+	if escaped {
+		return !strings.ContainsRune(k, 0) && !strings.ContainsRune(v, 0)
+	}
+	return !strings.ContainsAny(k, "\x00\r\n:") && !strings.ContainsAny(v, "\x00\r\n")
+}
+
+// UnmarshalFrame serializes a frame using STOMP 1.2 header escaping rules
+func UnmarshalFrame(frame Frame) []byte {
+	return UnmarshalFrameVersion(frame, VERSION_1_2)
+}
+
+// UnmarshalFrameVersion serializes a frame for a connection that negotiated version.
+// MESSAGE and ERROR frames always get a content-length header matching their body,
+// so clients can read bodies that contain NUL bytes. A header that cannot be written
+// safely for version is left out, see writableHeader.
+func UnmarshalFrameVersion(frame Frame, version string) []byte {
+	escaped := escapesHeaders(frame.Command, version)
+	setLength := frame.Command == MESSAGE || frame.Command == ERROR
+
+	var acc bytes.Buffer
+	acc.WriteString(frame.Command + "\n")
+	for k, v := range frame.Headers {
+		if setLength && k == "content-length" {
+			continue
+		}
+		if !writableHeader(k, v, escaped) {
+			continue
+		}
+		if escaped {
+			k = escapeHeader(k, version)
+			v = escapeHeader(v, version)
+		}
+		acc.WriteString(k + ":" + v + "\n")
+	}
+	if setLength {
+		acc.WriteString("content-length:" + strconv.Itoa(len(frame.Body)) + "\n")
+	}
+	acc.WriteString("\n")
+
+	acc.Write(frame.Body)
+	acc.WriteByte('\000')
+	return acc.Bytes()
 }
@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseFrames(t *testing.T) {
@@ -13,13 +17,19 @@ func TestParseFrames(t *testing.T) {
 		want Frame
 		err  bool // set to true if an error is expected
 	}{
-		{"SEND\n\n\000", Frame{Command: "SEND", Headers: emptMap, Body: ""}, false},
-		{"SEND\ncontent-length:0\n\n\000", Frame{Command: "SEND", Headers: map[string]string{"content-length": "0"}, Body: ""}, false},
+		{"SEND\n\n\000", Frame{Command: "SEND", Headers: emptMap, Body: []byte{}}, false},
+		{"SEND\ncontent-length:0\n\n\000", Frame{Command: "SEND", Headers: map[string]string{"content-length": "0"}, Body: []byte{}}, false},
 		{"SEND\n\n", Frame{}, true},
 		{"BOOGIE\n\n\000", Frame{}, true},
 		{"SEND\nbad header\n\000", Frame{}, true},
 		{"SEND\ncontent-length:15\n\nabcd\000", Frame{}, true},
-		{"SEND\ncontent-length:5\n\naaaaa\000", Frame{Command: "SEND", Headers: map[string]string{"content-length": "5"}, Body: "aaaaa"}, false},
+		{"SEND\ncontent-length:5\n\naaaaa\000", Frame{Command: "SEND", Headers: map[string]string{"content-length": "5"}, Body: []byte("aaaaa")}, false},
+		{"SEND\ncontent-length:3\n\na\000b\000", Frame{Command: "SEND", Headers: map[string]string{"content-length": "3"}, Body: []byte("a\000b")}, false},
+		{"SEND\ncorrelation:{\"a\"\\c1}\\n\\\\\n\n\000", Frame{Command: "SEND", Headers: map[string]string{"correlation": "{\"a\":1}\n\\"}, Body: []byte{}}, false},
+		{"SEND\nkey\\cwith\\ccolons:v\\r\n\n\000", Frame{Command: "SEND", Headers: map[string]string{"key:with:colons": "v\r"}, Body: []byte{}}, false},
+		{"SEND\nbad:escape\\t\n\n\000", Frame{}, true},
+		{"SEND\nbad:trailing\\\n\n\000", Frame{}, true},
+		{"CONNECT\nlogin:a\\cb\n\n\000", Frame{Command: "CONNECT", Headers: map[string]string{"login": "a\\cb"}, Body: []byte{}}, false},
 	}
 
 	for _, tt := range tests {
@@ -43,17 +53,237 @@ func TestUnmarshalFrame(t *testing.T) {
 		f    Frame
 		want string
 	}{
-		{Frame{Command: "SEND", Headers: emptMap, Body: ""}, "SEND\n\n\000"},
-		{Frame{Command: "SEND", Headers: map[string]string{"content-length": "5"}, Body: "aaaaa"}, "SEND\ncontent-length:5\n\naaaaa\000"},
+		{Frame{Command: "SEND", Headers: emptMap, Body: []byte{}}, "SEND\n\n\000"},
+		{Frame{Command: "SEND", Headers: map[string]string{"content-length": "5"}, Body: []byte("aaaaa")}, "SEND\ncontent-length:5\n\naaaaa\000"},
+		{Frame{Command: "MESSAGE", Headers: emptMap, Body: []byte("a\000b")}, "MESSAGE\ncontent-length:3\n\na\000b\000"},
+		{Frame{Command: "ERROR", Headers: map[string]string{"content-length": "99"}, Body: []byte("abc")}, "ERROR\ncontent-length:3\n\nabc\000"},
 	}
 
 	for _, tt := range tests {
 		testname := fmt.Sprintf("%+v", tt.f)
 		t.Run(testname, func(t *testing.T) {
-			unmarshalled := UnmarshalFrame(tt.f)
+			unmarshalled := string(UnmarshalFrame(tt.f))
 			if unmarshalled != tt.want {
 				t.Errorf("got %s / wanted %s\n", unmarshalled, tt.want)
 			}
 		})
 	}
 }
+
+func TestParseFrameVersion(t *testing.T) {
+	var tests = []struct {
+		raw     string
+		version string
+		want    Frame
+		err     bool // set to true if an error is expected
+	}{
+		{"SEND\nk:a\\cb\n\n\000", VERSION_1_0, Frame{Command: "SEND", Headers: map[string]string{"k": "a\\cb"}, Body: []byte{}}, false},
+		{"SEND\nk:a\\cb\n\n\000", VERSION_1_1, Frame{Command: "SEND", Headers: map[string]string{"k": "a:b"}, Body: []byte{}}, false},
+		{"SEND\nk:a\\rb\n\n\000", VERSION_1_1, Frame{}, true},
+		{"SEND\nk:a\\rb\n\n\000", VERSION_1_2, Frame{Command: "SEND", Headers: map[string]string{"k": "a\rb"}, Body: []byte{}}, false},
+	}
+
+	for _, tt := range tests {
+		testname := tt.version + " " + tt.raw
+		t.Run(testname, func(t *testing.T) {
+			parsed, err := ParseFrameVersion(tt.raw, tt.version)
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v / wanted error %v\n", err, tt.err)
+			}
+			if !reflect.DeepEqual(parsed, tt.want) {
+				t.Errorf("got %+v / wanted %+v\n", parsed, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalFrameUnwritableHeaders(t *testing.T) {
+	var tests = []struct {
+		version string
+		headers map[string]string
+		want    string
+	}{
+		{VERSION_1_0, map[string]string{"x": "a\nmessage-id:forged"}, "MESSAGE\ncontent-length:0\n\n\000"},
+		{VERSION_1_0, map[string]string{"x": "a\rb"}, "MESSAGE\ncontent-length:0\n\n\000"},
+		{VERSION_1_0, map[string]string{"a:b": "c"}, "MESSAGE\ncontent-length:0\n\n\000"},
+		{VERSION_1_0, map[string]string{"x": "a:b"}, "MESSAGE\nx:a:b\ncontent-length:0\n\n\000"},
+		{VERSION_1_2, map[string]string{"x": "a\nb"}, "MESSAGE\nx:a\\nb\ncontent-length:0\n\n\000"},
+		{VERSION_1_2, map[string]string{"x": "a\000b"}, "MESSAGE\ncontent-length:0\n\n\000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %q", tt.version, tt.headers), func(t *testing.T) {
+			f := Frame{Command: MESSAGE, Headers: tt.headers, Body: []byte{}}
+			if got := string(UnmarshalFrameVersion(f, tt.version)); got != tt.want {
+				t.Errorf("got %q / wanted %q\n", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderEscapeRoundTrip(t *testing.T) {
+	values := []string{"plain", "a:b", "line\nbreak", "back\\slash", "cr\r", `{"id":"x:y"}`}
+	for _, v := range values {
+		t.Run(v, func(t *testing.T) {
+			f := Frame{Command: MESSAGE, Headers: map[string]string{"correlation": v}, Body: []byte{}}
+			parsed, err := ParseFrame(string(UnmarshalFrame(f)))
+			if err != nil {
+				t.Errorf("got error: %s\n", err)
+			} else if parsed.Headers["correlation"] != v {
+				t.Errorf("got %q / wanted %q\n", parsed.Headers["correlation"], v)
+			}
+		})
+	}
+
+	connected := string(UnmarshalFrame(Frame{Command: CONNECTED, Headers: map[string]string{"server": "a:b"}, Body: []byte{}}))
+	if connected != "CONNECTED\nserver:a:b\n\n\000" {
+		t.Errorf("CONNECTED headers escaped: got %q\n", connected)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	var tests = []struct {
+		acceptVersion string
+		want          string
+		err           bool
+	}{
+		{"", "1.0", false},
+		{"1.0", "1.0", false},
+		{"1.0,1.1", "1.1", false},
+		{"1.1,1.2", "1.2", false},
+		{"1.2,1.0", "1.2", false},
+		{"2.0", "", true},
+		{"1.3,2.0", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptVersion, func(t *testing.T) {
+			version, err := negotiateVersion(tt.acceptVersion)
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v / wanted error %v\n", err, tt.err)
+			}
+			if version != tt.want {
+				t.Errorf("got %s / wanted %s\n", version, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrameReader(t *testing.T) {
+	large := strings.Repeat("x", 200*1024)
+	stream := "\n\r\nSEND\r\ndestination:/queue/a\r\n\r\nfirst\000\n" +
+		"SEND\ncontent-length:3\n\na\000b\000" +
+		"SEND\n\n" + large + "\000" +
+		"SEND\ncontent-length:" + strconv.Itoa(len(large)) + "\n\n" + large + "\000\n"
+	want := []Frame{
+		{Command: SEND, Headers: map[string]string{"destination": "/queue/a"}, Body: []byte("first")},
+		{Command: SEND, Headers: map[string]string{"content-length": "3"}, Body: []byte("a\000b")},
+		{Command: SEND, Headers: map[string]string{}, Body: []byte(large)},
+		{Command: SEND, Headers: map[string]string{"content-length": strconv.Itoa(len(large))}, Body: []byte(large)},
+	}
+
+	fr := NewFrameReader(strings.NewReader(stream))
+	for i := range want {
+		got, err := fr.ReadFrame(VERSION_1_2)
+		if err != nil {
+			t.Fatalf("frame %d: got error: %s\n", i, err)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("frame %d: got %s %v (%d body bytes) / wanted %s %v (%d body bytes)\n", i, got.Command, got.Headers, len(got.Body), want[i].Command, want[i].Headers, len(want[i].Body))
+		}
+	}
+	_, err := fr.ReadFrame(VERSION_1_2)
+	if err != io.EOF {
+		t.Errorf("got %v at end of stream / wanted io.EOF\n", err)
+	}
+}
+
+func TestFrameReaderErrors(t *testing.T) {
+	var tests = []struct {
+		raw  string
+		want string // substring expected in the error
+	}{
+		{"SEND\ndestination:/queue/a\n", "header line 2"},
+		{"SEND\nok:1\nbad header\n\n\000", "header line 2: malformed header"},
+		{"SEND\ncontent-length:abc\n\n\000", "invalid content-length"},
+		{"SEND\ncontent-length:2\n\nabc\000", "body longer than content-length 2"},
+		{"SEND\ncontent-length:5\n\nab", "fewer than content-length 5"},
+		{"SEND\n\nno terminator", "no NUL terminator"},
+		{"BOOGIE\n\n\000", "invalid command"},
+		{"SEND\n" + strings.Repeat("k", maxLineLength+1) + ":v\n\n\000", "line longer than"},
+	}
+
+	for _, tt := range tests {
+		testname := tt.want
+		t.Run(testname, func(t *testing.T) {
+			_, err := NewFrameReader(strings.NewReader(tt.raw)).ReadFrame(VERSION_1_2)
+			if err == nil {
+				t.Fatalf("expected an error containing %q\n", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %q / wanted it to contain %q\n", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrameReaderMaxBodySize(t *testing.T) {
+	limit := 10000
+	atLimit := strings.Repeat("x", limit)
+	var tests = []struct {
+		raw  string
+		want string // substring expected in the error, empty if the frame is accepted
+	}{
+		{"SEND\n\n" + atLimit + "\000", ""},
+		{"SEND\ncontent-length:10000\n\n" + atLimit + "\000", ""},
+		{"SEND\n\n" + atLimit + "x\000", "body larger than the maximum body size 10000"},
+		{"SEND\n\n" + strings.Repeat("x", 10*limit), "body larger than the maximum body size 10000"},
+		{"SEND\ncontent-length:10001\n\n" + atLimit + "x\000", "larger than the maximum body size 10000"},
+		{"SEND\ncontent-length:99999999999\n\n", "larger than the maximum body size 10000"},
+	}
+
+	for i, tt := range tests {
+		fr := NewFrameReader(strings.NewReader(tt.raw))
+		fr.SetMaxBodySize(limit)
+		f, err := fr.ReadFrame(VERSION_1_2)
+		if tt.want == "" {
+			if err != nil || len(f.Body) != limit {
+				t.Errorf("frame %d: got %d body bytes and error %v / wanted %d bytes\n", i, len(f.Body), err, limit)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("frame %d: got error %v / wanted it to contain %q\n", i, err, tt.want)
+		}
+	}
+}
+
+func TestNegotiateHeartbeat(t *testing.T) {
+	var tests = []struct {
+		header   string
+		canSend  time.Duration
+		wantRecv time.Duration
+		out      time.Duration
+		in       time.Duration
+		err      bool
+	}{
+		{"", 10 * time.Second, 30 * time.Second, 0, 0, false},
+		{"0,0", 10 * time.Second, 30 * time.Second, 0, 0, false},
+		{"5000,20000", 10 * time.Second, 30 * time.Second, 20 * time.Second, 30 * time.Second, false},
+		{"60000,1000", 10 * time.Second, 30 * time.Second, 10 * time.Second, 60 * time.Second, false},
+		{"1000,1000", 0, 0, 0, 0, false},
+		{"1000", 10 * time.Second, 30 * time.Second, 0, 0, true},
+		{"a,b", 10 * time.Second, 30 * time.Second, 0, 0, true},
+		{"-1,0", 10 * time.Second, 30 * time.Second, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			out, in, err := negotiateHeartbeat(tt.header, tt.canSend, tt.wantRecv)
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v / wanted error %v\n", err, tt.err)
+			}
+			if out != tt.out || in != tt.in {
+				t.Errorf("got out %v in %v / wanted out %v in %v\n", out, in, tt.out, tt.in)
+			}
+		})
+	}
+}
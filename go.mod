@@ -3,8 +3,9 @@ module github.com/tydar/stomper
 go 1.17
 
 require (
-	github.com/google/uuid v1.3.0
+	github.com/google/uuid v1.6.0
 	github.com/spf13/viper v1.9.0
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
 
 require (
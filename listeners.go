@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listener types
+const (
+	LISTENER_TCP       = "tcp"
+	LISTENER_TCP6      = "tcp6"
+	LISTENER_UNIX      = "unix"
+	LISTENER_TLS       = "tls"
+	LISTENER_WEBSOCKET = "websocket"
+)
+
+// ListenerConfig describes one address the ConnectionManager accepts connections on
+type ListenerConfig struct {
+	Type    string `mapstructure:"type"`    // tcp, tcp6, unix, tls or websocket
+	Address string `mapstructure:"address"` // host:port, or the socket file path for unix
+	Mode    string `mapstructure:"mode"`    // unix only: octal permissions for the socket file, e.g. 0660
+
+	Path string `mapstructure:"path"` // websocket only: HTTP path to accept upgrades on
+
+	// tls only; see NewTLSConfig and ConfigureClientAuth
+	CertFile        string   `mapstructure:"certfile"`
+	KeyFile         string   `mapstructure:"keyfile"`
+	MinVersion      string   `mapstructure:"minversion"`
+	CipherSuites    []string `mapstructure:"ciphersuites"`
+	ClientAuth      string   `mapstructure:"clientauth"`
+	ClientCAFile    string   `mapstructure:"clientcafile"`
+	ClientPrincipal string   `mapstructure:"clientprincipal"`
+}
+
+// listenerSpec is a validated ListenerConfig, ready to listen on
+type listenerSpec struct {
+	kind      string
+	address   string
+	mode      os.FileMode
+	wsPath    string
+	tlsConfig *tls.Config
+	certField string // which client certificate field names the peer
+}
+
+func newListenerSpec(lc ListenerConfig) (*listenerSpec, error) {
+	if lc.Address == "" {
+		return nil, fmt.Errorf("%s listener: no address", lc.Type)
+	}
+	spec := &listenerSpec{
+		kind:    lc.Type,
+		address: lc.Address,
+	}
+
+	switch lc.Type {
+	case LISTENER_TCP, LISTENER_TCP6:
+	case LISTENER_UNIX:
+		if lc.Mode != "" {
+			mode, err := strconv.ParseUint(lc.Mode, 8, 32)
+			if err != nil || mode > 0777 {
+				return nil, fmt.Errorf("unix listener %s: bad mode %s", lc.Address, lc.Mode)
+			}
+			spec.mode = os.FileMode(mode)
+		}
+	case LISTENER_TLS:
+		config, err := NewTLSConfig(lc.CertFile, lc.KeyFile, lc.MinVersion, lc.CipherSuites)
+		if err != nil {
+			return nil, fmt.Errorf("tls listener %s: %w", lc.Address, err)
+		}
+		err = ConfigureClientAuth(config, lc.ClientAuth, lc.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls listener %s: %w", lc.Address, err)
+		}
+		if lc.ClientPrincipal == "" {
+			lc.ClientPrincipal = CERT_PRINCIPAL_CN
+		}
+		err = validateCertPrincipal(lc.ClientPrincipal)
+		if err != nil {
+			return nil, fmt.Errorf("tls listener %s: %w", lc.Address, err)
+		}
+		spec.tlsConfig = config
+		spec.certField = lc.ClientPrincipal
+	case LISTENER_WEBSOCKET:
+		spec.wsPath = lc.Path
+		if spec.wsPath == "" {
+			spec.wsPath = "/stomp"
+		}
+	default:
+		return nil, fmt.Errorf("unknown listener type %s, expected tcp, tcp6, unix, tls or websocket", lc.Type)
+	}
+	return spec, nil
+}
+
+func (spec *listenerSpec) listen() (net.Listener, error) {
+	switch spec.kind {
+	case LISTENER_TCP6:
+		return net.Listen("tcp6", spec.address)
+	case LISTENER_UNIX:
+		return listenUnix(spec.address, spec.mode)
+	case LISTENER_TLS:
+		l, err := net.Listen("tcp", spec.address)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, spec.tlsConfig), nil
+	case LISTENER_WEBSOCKET:
+		l, err := net.Listen("tcp", spec.address)
+		if err != nil {
+			return nil, err
+		}
+		return newWSListener(l, spec.wsPath), nil
+	default:
+		return net.Listen("tcp", spec.address)
+	}
+}
+
+// listenUnix listens on a unix socket at path, replacing a socket file left behind by an earlier run
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		err = os.Chmod(path, mode)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
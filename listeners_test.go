@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewListenerSpecErrors(t *testing.T) {
+	tests := map[string]ListenerConfig{
+		"unknown type":   {Type: "udp", Address: ":32807"},
+		"no address":     {Type: LISTENER_TCP},
+		"bad mode":       {Type: LISTENER_UNIX, Address: "/tmp/stomper.sock", Mode: "rw-rw----"},
+		"mode too large": {Type: LISTENER_UNIX, Address: "/tmp/stomper.sock", Mode: "7777"},
+		"tls no cert":    {Type: LISTENER_TLS, Address: ":32807"},
+	}
+
+	for name, lc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := newListenerSpec(lc)
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestConnectionManagerListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "stomper.sock")
+
+	// a socket file left behind by an earlier run is replaced
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	messages := make(chan CnxMgrMsg)
+	cm := NewConnectionManager("", 32807, messages, 1)
+	err = cm.AddListener(ListenerConfig{Type: LISTENER_UNIX, Address: sock, Mode: "0660"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.AddListener(ListenerConfig{Type: LISTENER_TCP, Address: ":32807"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.Start()
+	if err != nil {
+		t.Fatal("error starting cnx manager: ", err)
+	}
+	defer cm.Stop()
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("got socket mode %o wanted 0660", fi.Mode().Perm())
+	}
+
+	for _, addr := range [][2]string{{"unix", sock}, {"tcp", ":32807"}} {
+		t.Run("_"+addr[0], func(t *testing.T) {
+			conn, err := net.Dial(addr[0], addr[1])
+			if err != nil {
+				t.Fatal("could not connect to server: ", err)
+			}
+			msg := <-messages
+			if msg.Type != NEW_CONNECTION {
+				t.Fatalf("expected NEW_CONNECTION, got %+v", msg)
+			}
+
+			_, err = conn.Write([]byte("CONNECT\naccept-version:1.2\n\n\000"))
+			if err != nil {
+				t.Fatal("write error: ", err)
+			}
+			msg = <-messages
+			if msg.Type != FRAME || msg.Err != nil || msg.Frame.Command != CONNECT {
+				t.Errorf("did not receive CONNECT frame: %+v", msg)
+			}
+			conn.Close()
+			<-messages
+		})
+	}
+
+	// a socket another server is listening on is left alone
+	other := NewConnectionManager("", 0, make(chan CnxMgrMsg), 1)
+	err = other.AddListener(ListenerConfig{Type: LISTENER_UNIX, Address: sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Start()
+	if err == nil {
+		other.Stop()
+		t.Error("expected error listening on a socket in use, got nil")
+	}
+	// the probe shows up as a connection that closes straight away
+	<-messages
+	<-messages
+}
@@ -5,6 +5,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -13,12 +17,34 @@ func main() {
 	viper.SetDefault("Port", 32801)
 	viper.SetDefault("Hostname", "localhost")
 	viper.SetDefault("TCPDeadline", 0)
+	viper.SetDefault("HeartbeatSend", 10)
+	viper.SetDefault("ShutdownTimeout", 30)
+	viper.SetDefault("TransactionTimeout", 60)
+	viper.SetDefault("TransactionMaxFrames", 1000)
+	viper.SetDefault("MaxBodySize", DefaultMaxBodySize)
+	viper.SetDefault("OutboundQueueSize", DefaultOutboundConfig.QueueSize)
+	viper.SetDefault("WriteTimeout", int(DefaultOutboundConfig.WriteTimeout/time.Second))
+	viper.SetDefault("SlowConsumerPolicy", DefaultOutboundConfig.Policy)
 	viper.SetDefault("LogPath", "./stomper.log")
 	viper.SetDefault("LogToFile", true)
 	viper.SetDefault("LogToStdout", false)
 	viper.SetDefault("SendWorkers", 1)
 	viper.SetDefault("MetricsServer", false)
 	viper.SetDefault("MetricsAddress", ":8080")
+	viper.SetDefault("TLSCertFile", "")
+	viper.SetDefault("TLSKeyFile", "")
+	viper.SetDefault("TLSPort", 0)
+	viper.SetDefault("TLSMinVersion", "1.2")
+	viper.SetDefault("TLSCipherSuites", []string{})
+	viper.SetDefault("TLSClientAuth", "none")
+	viper.SetDefault("TLSClientCAFile", "")
+	viper.SetDefault("TLSClientPrincipal", "cn")
+	viper.SetDefault("WebSocketPort", 0)
+	viper.SetDefault("WebSocketPath", "/stomp")
+	viper.SetDefault("UsersFile", "")
+	viper.SetDefault("Store", "memory")
+	viper.SetDefault("StorePath", "./stomper_data")
+	viper.SetDefault("StoreSegmentSize", DefaultSegmentSize)
 
 	// for now, we'll set one default queue to be /queue/main
 	// and topics will be created as a string array from the config file
@@ -64,24 +90,162 @@ func main() {
 	comms := make(chan CnxMgrMsg)
 	cm := NewConnectionManager(viper.GetString("hostname"), viper.GetInt("port"), comms, viper.GetDuration("tcpdeadline"))
 
+	err = cm.SetMaxBodySize(viper.GetInt("MaxBodySize"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("fatal error in config: %w", err))
+	}
+
+	err = cm.SetOutbound(OutboundConfig{
+		QueueSize:    viper.GetInt("OutboundQueueSize"),
+		WriteTimeout: viper.GetDuration("WriteTimeout") * time.Second,
+		Policy:       viper.GetString("SlowConsumerPolicy"),
+	})
+	if err != nil {
+		log.Fatal(fmt.Errorf("fatal error in outbound config: %w", err))
+	}
+
+	var listeners []ListenerConfig
+	if viper.IsSet("Listeners") {
+		err = viper.UnmarshalKey("Listeners", &listeners)
+		if err != nil {
+			log.Fatal(fmt.Errorf("fatal error reading listeners: %w", err))
+		}
+	} else {
+		listeners = defaultListeners()
+	}
+	for i := range listeners {
+		err = cm.AddListener(listeners[i])
+		if err != nil {
+			log.Fatal(fmt.Errorf("fatal error in listener config: %w", err))
+		}
+	}
+
 	topics := viper.GetStringSlice("topics")
-	stQueues := make(map[string][][]Frame)
-	for i := range topics {
-		_, prs := stQueues[topics[i]]
-		if prs {
-			log.Printf("DUPLICATE_TOPIC: duplicate topics %s defined in config\n", topics[i])
-		} else {
-			log.Printf("CREATING_TOPIC: %s\n", topics[i])
-			stQueues[topics[i]] = make([][]Frame, 0)
+	var st Store
+	switch viper.GetString("store") {
+	case "memory":
+		stQueues := make(map[string][][]Frame)
+		for i := range topics {
+			_, prs := stQueues[topics[i]]
+			if prs {
+				log.Printf("DUPLICATE_TOPIC: duplicate topics %s defined in config\n", topics[i])
+			} else {
+				log.Printf("CREATING_TOPIC: %s\n", topics[i])
+				stQueues[topics[i]] = make([][]Frame, 0)
+			}
+		}
+		st = &MemoryStore{
+			Queues: stQueues,
 		}
+	case "file":
+		fs, err := NewFileStore(viper.GetString("storepath"), viper.GetInt64("storesegmentsize"))
+		if err != nil {
+			log.Fatal(fmt.Errorf("fatal error opening file store: %w", err))
+		}
+		// topics recovered from the log already exist, so only new ones are created
+		for i := range topics {
+			if !fs.Prs(topics[i]) {
+				log.Printf("CREATING_TOPIC: %s\n", topics[i])
+				err = fs.AddDestination(topics[i])
+				if err != nil {
+					log.Fatal(fmt.Errorf("fatal error creating topic %s: %w", topics[i], err))
+				}
+			}
+		}
+		st = fs
+	default:
+		log.Fatalf("CONFIG: unknown store %s, expected memory or file\n", viper.GetString("store"))
 	}
-	st := &MemoryStore{
-		Queues: stQueues,
+
+	if viper.GetInt("SendWorkers") < 1 {
+		log.Fatalf("CONFIG: SendWorkers must be at least 1, got %d\n", viper.GetInt("SendWorkers"))
 	}
 
-	e := NewEngine(st, cm, comms, viper.GetInt("SendWorkers"), viper.GetBool("MetricsServer"), viper.GetString("MetricsAddress"))
+	e := NewEngine(st, cm, comms, viper.GetInt("SendWorkers"), viper.GetBool("MetricsServer"), viper.GetString("MetricsAddress"), viper.GetDuration("HeartbeatSend")*time.Second)
+	e.TM.SetLimits(viper.GetDuration("TransactionTimeout")*time.Second, viper.GetInt("TransactionMaxFrames"))
+
+	// with no users file configured, any client may connect
+	if usersFile := viper.GetString("UsersFile"); usersFile != "" {
+		auth, err := NewFileAuthenticator(usersFile)
+		if err != nil {
+			log.Fatal(fmt.Errorf("fatal error loading users file: %w", err))
+		}
+		log.Printf("CONFIG: authenticating clients against %s\n", usersFile)
+		e.Auth = auth
+	}
+
+	// with no acl configured, any client may read and write any destination
+	if viper.IsSet("ACL") {
+		var rules []ACLRule
+		err = viper.UnmarshalKey("ACL", &rules)
+		if err != nil {
+			log.Fatal(fmt.Errorf("fatal error reading acl: %w", err))
+		}
+		acl, err := NewACL(rules, viper.GetStringMapStringSlice("Groups"))
+		if err != nil {
+			log.Fatal(fmt.Errorf("fatal error in acl: %w", err))
+		}
+		log.Printf("CONFIG: enforcing %d acl rules\n", len(rules))
+		e.ACL = acl
+
+		if viper.GetString("UsersFile") == "" {
+			// without a users file, a client is whoever its login header says it is
+			log.Println("WARNING: ACL is set but UsersFile is not, so clients without a verified TLS client certificate can claim any login the ACL grants access to")
+		}
+	}
+
+	// SIGTERM (e.g. from Kubernetes) and SIGINT drain the engine, which makes Start return
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("SHUTDOWN: received %v\n", sig)
+		e.Shutdown(viper.GetDuration("ShutdownTimeout") * time.Second)
+	}()
+
 	err = e.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// defaultListeners builds the listeners from the Port, TLS and WebSocket settings when no listeners list is configured.
+// TLS is served when a certificate is configured, alongside plaintext only if it has its own port.
+func defaultListeners() []ListenerConfig {
+	host := viper.GetString("Hostname")
+	port := viper.GetInt("Port")
+	tlsPort := viper.GetInt("TLSPort")
+	certFile := viper.GetString("TLSCertFile")
+
+	var listeners []ListenerConfig
+	if certFile == "" || tlsPort != 0 {
+		listeners = append(listeners, ListenerConfig{
+			Type:    LISTENER_TCP,
+			Address: host + ":" + strconv.Itoa(port),
+		})
+	}
+	if certFile != "" {
+		if tlsPort == 0 {
+			tlsPort = port
+		}
+		listeners = append(listeners, ListenerConfig{
+			Type:            LISTENER_TLS,
+			Address:         host + ":" + strconv.Itoa(tlsPort),
+			CertFile:        certFile,
+			KeyFile:         viper.GetString("TLSKeyFile"),
+			MinVersion:      viper.GetString("TLSMinVersion"),
+			CipherSuites:    viper.GetStringSlice("TLSCipherSuites"),
+			ClientAuth:      viper.GetString("TLSClientAuth"),
+			ClientCAFile:    viper.GetString("TLSClientCAFile"),
+			ClientPrincipal: viper.GetString("TLSClientPrincipal"),
+		})
+	}
+	if wsPort := viper.GetInt("WebSocketPort"); wsPort != 0 {
+		listeners = append(listeners, ListenerConfig{
+			Type:    LISTENER_WEBSOCKET,
+			Address: host + ":" + strconv.Itoa(wsPort),
+			Path:    viper.GetString("WebSocketPath"),
+		})
+	}
+	return listeners
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -12,7 +14,12 @@ type MetricsService struct {
 	SentCount       uint64
 	ReceivedCount   uint64
 	ErrorCount      uint64
+	DeniedCount     uint64
+	HandshakeFailed uint64
 	serverStartTime time.Time
+	server          *http.Server
+	outboundStats   func() OutboundStats
+	mu              sync.Mutex // guards server while it is set up
 }
 
 func NewMetricsService() *MetricsService {
@@ -21,7 +28,10 @@ func NewMetricsService() *MetricsService {
 		SentCount:       0,
 		ReceivedCount:   0,
 		ErrorCount:      0,
+		DeniedCount:     0,
+		HandshakeFailed: 0,
 		serverStartTime: now,
+		server:          &http.Server{},
 	}
 }
 
@@ -41,6 +51,16 @@ func (ms *MetricsService) IncError() {
 	atomic.AddUint64(&ms.ErrorCount, uint64(1))
 }
 
+// IncDenied counts an operation refused by the ACL
+func (ms *MetricsService) IncDenied() {
+	atomic.AddUint64(&ms.DeniedCount, uint64(1))
+}
+
+// IncHandshakeFailed counts a TLS handshake the ConnectionManager rejected
+func (ms *MetricsService) IncHandshakeFailed() {
+	atomic.AddUint64(&ms.HandshakeFailed, uint64(1))
+}
+
 func (ms *MetricsService) GetSentCount() uint64 {
 	return atomic.LoadUint64(&ms.SentCount)
 }
@@ -53,6 +73,26 @@ func (ms *MetricsService) GetErrorCount() uint64 {
 	return atomic.LoadUint64(&ms.ErrorCount)
 }
 
+func (ms *MetricsService) GetDeniedCount() uint64 {
+	return atomic.LoadUint64(&ms.DeniedCount)
+}
+
+func (ms *MetricsService) GetHandshakeFailed() uint64 {
+	return atomic.LoadUint64(&ms.HandshakeFailed)
+}
+
+// SetOutboundStats sets where connection outbound queue metrics are read from; call it before serving
+func (ms *MetricsService) SetOutboundStats(f func() OutboundStats) {
+	ms.outboundStats = f
+}
+
+func (ms *MetricsService) GetOutboundStats() OutboundStats {
+	if ms.outboundStats == nil {
+		return OutboundStats{}
+	}
+	return ms.outboundStats()
+}
+
 func (ms *MetricsService) GetServerStartTime() time.Time {
 	// no need for atomic here bc it will not be manipulated after initialization
 	return ms.serverStartTime
@@ -64,6 +104,9 @@ type metricsResponse struct {
 	SentCount       uint64
 	ReceivedCount   uint64
 	ErrorCount      uint64
+	DeniedCount     uint64
+	HandshakeFailed uint64
+	Outbound        OutboundStats
 	ServerStartTime time.Time
 	Timestamp       time.Time
 }
@@ -75,6 +118,9 @@ func (ms *MetricsService) ListenAndServeJSON(addr string) {
 			SentCount:       ms.GetSentCount(),
 			ReceivedCount:   ms.GetReceivedCount(),
 			ErrorCount:      ms.GetErrorCount(),
+			DeniedCount:     ms.GetDeniedCount(),
+			HandshakeFailed: ms.GetHandshakeFailed(),
+			Outbound:        ms.GetOutboundStats(),
 			ServerStartTime: ms.GetServerStartTime(),
 			Timestamp:       time.Now(),
 		}
@@ -84,5 +130,21 @@ func (ms *MetricsService) ListenAndServeJSON(addr string) {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/stomper", metricsHandler)
-	http.ListenAndServe(addr, mux)
+
+	ms.mu.Lock()
+	ms.server.Addr = addr
+	ms.server.Handler = mux
+	ms.mu.Unlock()
+
+	err := ms.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("METRICS_ERROR: %v\n", err)
+	}
+}
+
+// Shutdown stops the metrics server, waiting for open requests until ctx is done
+func (ms *MetricsService) Shutdown(ctx context.Context) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.server.Shutdown(ctx)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+)
+
+// session states, in the order a well-behaved client moves through them
+const (
+	SESSION_AWAITING_CONNECT = iota
+	SESSION_AUTHENTICATING
+	SESSION_CONNECTED
+	SESSION_DISCONNECTING
+)
+
+// Session tracks the protocol state of one connection.
+// Sessions are owned by the engine's main loop, so they need no locking.
+type Session struct {
+	ID        string
+	State     int
+	Principal Principal   // set once the session has authenticated
+	held      []CnxMgrMsg // frames sent while authenticating, handled once connected
+}
+
+func NewSession(id string) *Session {
+	return &Session{
+		ID:    id,
+		State: SESSION_AWAITING_CONNECT,
+	}
+}
+
+// Allows returns an error if a frame with the given command is out of order for the session's state
+func (s *Session) Allows(command string) error {
+	switch command {
+	case CONNECTED, MESSAGE, RECEIPT, ERROR:
+		return fmt.Errorf("%s frames may only be sent by the server", command)
+	}
+
+	switch s.State {
+	case SESSION_AWAITING_CONNECT:
+		if command != CONNECT && command != STOMP {
+			return fmt.Errorf("expected CONNECT or STOMP frame, got %s", command)
+		}
+	case SESSION_AUTHENTICATING:
+		if command == CONNECT || command == STOMP {
+			return fmt.Errorf("session %s is already connecting", s.ID)
+		}
+	case SESSION_CONNECTED:
+		if command == CONNECT || command == STOMP {
+			return fmt.Errorf("session %s is already connected", s.ID)
+		}
+	case SESSION_DISCONNECTING:
+		return fmt.Errorf("session %s is disconnecting, got %s", s.ID, command)
+	}
+	return nil
+}
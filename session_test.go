@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSessionAllows(t *testing.T) {
+	var tests = []struct {
+		state   int
+		command string
+		err     bool // set to true if the frame should be rejected
+	}{
+		{SESSION_AWAITING_CONNECT, CONNECT, false},
+		{SESSION_AWAITING_CONNECT, STOMP, false},
+		{SESSION_AWAITING_CONNECT, SEND, true},
+		{SESSION_AWAITING_CONNECT, SUBSCRIBE, true},
+		{SESSION_AWAITING_CONNECT, DISCONNECT, true},
+		{SESSION_AUTHENTICATING, SEND, false},
+		{SESSION_AUTHENTICATING, CONNECT, true},
+		{SESSION_CONNECTED, SEND, false},
+		{SESSION_CONNECTED, SUBSCRIBE, false},
+		{SESSION_CONNECTED, DISCONNECT, false},
+		{SESSION_CONNECTED, CONNECT, true},
+		{SESSION_CONNECTED, MESSAGE, true},
+		{SESSION_DISCONNECTING, SEND, true},
+		{SESSION_DISCONNECTING, DISCONNECT, true},
+	}
+
+	for _, tt := range tests {
+		testname := tt.command
+		t.Run(testname, func(t *testing.T) {
+			s := NewSession("test")
+			s.State = tt.state
+			err := s.Allows(tt.command)
+			if (err != nil) != tt.err {
+				t.Errorf("state %d command %s: got error %v / wanted error %v\n", tt.state, tt.command, err, tt.err)
+			}
+		})
+	}
+}
@@ -10,12 +10,33 @@ type Store interface {
 	// defines the methods required for a store to back
 	// the queueing service
 	Enqueue(destination string, message Frame) error
-	EnqueueTx(tx map[string]Frame) error
+	// EnqueueTx enqueues each message on the destination in its destination header, in order.
+	// Either every message is enqueued or, if any destination does not exist, none is.
+	EnqueueTx(tx []Frame) error
 	Pop(destination string) ([]Frame, error)
+	// Ack settles a popped message that has been delivered for good. A durable store keeps a popped
+	// message until it is acked, so that one a crash left unacknowledged is delivered again.
+	Ack(destination string, message Frame) error
+	// Requeue puts a popped message back at the head of its queue
+	Requeue(destination string, message Frame) error
 	Len(destination string) (int, error)
 	Destinations() []string
 	AddDestination(destination string) error
 	Prs(destination string) bool
+	// Close releases the store's resources once nothing will use it again
+	Close() error
+	// Notify returns a channel that receives a value after messages are added to any destination.
+	// Wake-ups are coalesced, so the receiver should check every destination when woken.
+	Notify() <-chan struct{}
+}
+
+// signalAvailable wakes whoever is waiting on a notify channel without blocking;
+// a wake-up that is already pending covers this one too
+func signalAvailable(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
 }
 
 type MemoryStore struct {
@@ -23,6 +44,7 @@ type MemoryStore struct {
 	// Concurrency protected by sync.Mutex
 	sync.Mutex
 	Queues map[string][][]Frame
+	notify chan struct{} // made on first use, so a literal MemoryStore works
 }
 
 func (m *MemoryStore) Enqueue(destination string, message Frame) error {
@@ -31,25 +53,28 @@ func (m *MemoryStore) Enqueue(destination string, message Frame) error {
 	q, prs := m.Queues[destination]
 	if prs {
 		m.Queues[destination] = append(q, []Frame{message})
+		m.signal()
 		return nil
 	} else {
 		return errors.New("no such destination")
 	}
 }
 
-func (m *MemoryStore) EnqueueTx(tx map[string]Frame) error {
+func (m *MemoryStore) EnqueueTx(tx []Frame) error {
 	m.Lock()
 	defer m.Unlock()
 
-	for k, v := range tx {
-		q, prs := m.Queues[k]
-		if prs {
-			m.Queues[k] = append(q, []Frame{v})
-		} else {
+	for _, v := range tx {
+		if _, prs := m.Queues[v.Headers["destination"]]; !prs {
 			return errors.New("bad destination for at least one frame")
 		}
 	}
+	for _, v := range tx {
+		dest := v.Headers["destination"]
+		m.Queues[dest] = append(m.Queues[dest], []Frame{v})
+	}
 
+	m.signal()
 	return nil
 }
 
@@ -71,6 +96,26 @@ func (m *MemoryStore) Pop(destination string) ([]Frame, error) {
 	return f, nil
 }
 
+// Ack does nothing, since a MemoryStore does not outlive its messages in flight
+func (m *MemoryStore) Ack(destination string, message Frame) error {
+	return nil
+}
+
+// Requeue puts a message back at the head of the destination queue,
+// e.g. when a client NACKs it or disconnects before ACKing it
+func (m *MemoryStore) Requeue(destination string, message Frame) error {
+	m.Lock()
+	defer m.Unlock()
+	q, prs := m.Queues[destination]
+	if !prs {
+		return errors.New("no such destination")
+	}
+
+	m.Queues[destination] = append([][]Frame{{message}}, q...)
+	m.signal()
+	return nil
+}
+
 func (m *MemoryStore) AddDestination(destination string) error {
 	if m.Prs(destination) {
 		return fmt.Errorf("destination %s already exists", destination)
@@ -113,3 +158,24 @@ func (m *MemoryStore) Destinations() []string {
 	}
 	return keys
 }
+
+// Close is a no-op: a MemoryStore holds nothing outside the process
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) Notify() <-chan struct{} {
+	m.Lock()
+	defer m.Unlock()
+	if m.notify == nil {
+		m.notify = make(chan struct{}, 1)
+	}
+	return m.notify
+}
+
+// signal assumes m is locked. Until Notify is first called there is no one to wake.
+func (m *MemoryStore) signal() {
+	if m.notify != nil {
+		signalAvailable(m.notify)
+	}
+}
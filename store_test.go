@@ -12,7 +12,7 @@ func TestMemoryStoreEnqueue(t *testing.T) {
 		"/queue/test": make([][]Frame, 0),
 	}
 	emptHead := make(map[string]string)
-	fr := Frame{Command: "SEND", Headers: emptHead, Body: ""}
+	fr := Frame{Command: "SEND", Headers: emptHead, Body: []byte{}}
 	var tests = []struct {
 		initial map[string][][]Frame
 		dest    string
@@ -53,7 +53,7 @@ func TestMemoryStoreEnqueue(t *testing.T) {
 
 func TestMemoryStorePop(t *testing.T) {
 	emptHead := make(map[string]string)
-	fr := Frame{Command: "SEND", Headers: emptHead, Body: ""}
+	fr := Frame{Command: "SEND", Headers: emptHead, Body: []byte{}}
 	emptMap := make(map[string][][]Frame)
 	mapWithOne := map[string][][]Frame{
 		"/queue/test": {{fr}},
@@ -123,3 +123,53 @@ func TestMemoryStoreAddPrs(t *testing.T) {
 	}
 
 }
+
+func TestMemoryStoreRequeue(t *testing.T) {
+	first := Frame{Command: "MESSAGE", Headers: map[string]string{"message-id": "1"}, Body: []byte{}}
+	second := Frame{Command: "MESSAGE", Headers: map[string]string{"message-id": "2"}, Body: []byte{}}
+	ms := MemoryStore{Queues: map[string][][]Frame{"/queue/test": {{second}}}}
+
+	err := ms.Requeue("/queue/test", first)
+	if err != nil {
+		t.Error("requeue error: ", err)
+	}
+
+	want := map[string][][]Frame{"/queue/test": {{first}, {second}}}
+	if !reflect.DeepEqual(ms.Queues, want) {
+		t.Errorf("got %+v / wanted %+v\n", ms.Queues, want)
+	}
+
+	err = ms.Requeue("/queue/none", first)
+	if err == nil {
+		t.Error("requeue allowed to nonexistent destination")
+	}
+}
+
+func TestMemoryStoreEnqueueTx(t *testing.T) {
+	frameTo := func(dest, body string) Frame {
+		return Frame{Command: "MESSAGE", Headers: map[string]string{"destination": dest}, Body: []byte(body)}
+	}
+	ms := MemoryStore{Queues: map[string][][]Frame{"/queue/a": {}, "/queue/b": {}}}
+
+	err := ms.EnqueueTx([]Frame{frameTo("/queue/a", "tx"), frameTo("/queue/none", "tx")})
+	if err == nil {
+		t.Error("allowed transaction with a bad destination")
+	}
+	if l, _ := ms.Len("/queue/a"); l != 0 {
+		t.Errorf("failed transaction partially applied: /queue/a has %d messages", l)
+	}
+
+	// two messages to one destination are both kept, in the order they were sent
+	tx := []Frame{frameTo("/queue/a", "1"), frameTo("/queue/b", "2"), frameTo("/queue/a", "3")}
+	err = ms.EnqueueTx(tx)
+	if err != nil {
+		t.Error("transaction error: ", err)
+	}
+	want := map[string][][]Frame{
+		"/queue/a": {{tx[0]}, {tx[2]}},
+		"/queue/b": {{tx[1]}},
+	}
+	if !reflect.DeepEqual(ms.Queues, want) {
+		t.Errorf("got %+v / wanted %+v\n", ms.Queues, want)
+	}
+}
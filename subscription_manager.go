@@ -3,58 +3,108 @@ package main
 import (
 	"fmt"
 	"log"
-	"strings"
+	"sync"
 )
 
+// SubscriptionManager is shared by the engine's main loop, which subscribes and unsubscribes,
+// and the dispatch loop, which looks subscriptions up by destination, so every method locks
 type SubscriptionManager struct {
+	// Subscriptions maps internal subscription IDs to subscriptions; hold mu to use it directly
 	Subscriptions map[string]Subscription
+	byDestination map[string]map[string]Subscription // destination -> internal sub ID -> subscription
+	byClient      map[string]map[string]Subscription // client ID -> sub ID -> subscription
+	notify        chan struct{}
+	mu            sync.RWMutex
 }
 
 func NewSubscriptionManager() *SubscriptionManager {
 	return &SubscriptionManager{
 		Subscriptions: make(map[string]Subscription),
+		byDestination: make(map[string]map[string]Subscription),
+		byClient:      make(map[string]map[string]Subscription),
+		notify:        make(chan struct{}, 1),
 	}
 }
 
-func (sm *SubscriptionManager) Subscribe(clientID string, subID string, dest string) error {
-	internalSubID := clientID + "_" + subID
-	_, prs := sm.Subscriptions[internalSubID]
-	if prs {
+// Notify returns a channel that receives a value after a new subscription is made,
+// since messages held for a destination with no subscribers can now be delivered
+func (sm *SubscriptionManager) Notify() <-chan struct{} {
+	return sm.notify
+}
+
+func (sm *SubscriptionManager) Subscribe(clientID string, subID string, dest string, ackMode string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, prs := sm.byClient[clientID][subID]; prs {
 		return fmt.Errorf("subscription from client %s with sub ID %s already exists", clientID, subID)
 	}
 
-	sm.Subscriptions[internalSubID] = Subscription{
+	sub := Subscription{
 		ID:          subID,
 		Destination: dest,
 		ClientID:    clientID,
+		AckMode:     ackMode,
+	}
+	internalSubID := sub.InternalSubID()
+	sm.Subscriptions[internalSubID] = sub
+	if sm.byDestination[dest] == nil {
+		sm.byDestination[dest] = make(map[string]Subscription)
 	}
-	log.Printf("NEW_SUBSCRIPTION: Sub %s from client %s to dest %s\n", subID, clientID, dest)
+	sm.byDestination[dest][internalSubID] = sub
+	if sm.byClient[clientID] == nil {
+		sm.byClient[clientID] = make(map[string]Subscription)
+	}
+	sm.byClient[clientID][subID] = sub
+
+	log.Printf("NEW_SUBSCRIPTION: Sub %s from client %s to dest %s with ack mode %s\n", subID, clientID, dest, ackMode)
+	signalAvailable(sm.notify)
 	return nil
 }
 
 func (sm *SubscriptionManager) Unsubscribe(clientID string, subID string) error {
-	internalSubID := clientID + "_" + subID
-	sub, prs := sm.Subscriptions[internalSubID]
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sub, prs := sm.byClient[clientID][subID]
 	if !prs {
 		return fmt.Errorf("no such subscription %s for client %s", subID, clientID)
 	}
 	log.Printf("UNSUBSCRIBE: sub %s from client %s to dest %s\n", subID, clientID, sub.Destination)
-	delete(sm.Subscriptions, internalSubID)
+	sm.remove(sub)
 	return nil
 }
 
 func (sm *SubscriptionManager) UnsubscribeAll(clientID string) {
-	for k := range sm.Subscriptions {
-		if strings.HasPrefix(k, clientID) {
-			delete(sm.Subscriptions, k)
-		}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for _, sub := range sm.byClient[clientID] {
+		sm.remove(sub)
 	}
 	log.Printf("UNSUBSCRIBE_ALL for client %s", clientID)
 }
 
+// remove deletes a subscription from the map and both indexes; assumes sm.mu is held
+func (sm *SubscriptionManager) remove(sub Subscription) {
+	internalSubID := sub.InternalSubID()
+	delete(sm.Subscriptions, internalSubID)
+
+	delete(sm.byDestination[sub.Destination], internalSubID)
+	if len(sm.byDestination[sub.Destination]) == 0 {
+		delete(sm.byDestination, sub.Destination)
+	}
+	delete(sm.byClient[sub.ClientID], sub.ID)
+	if len(sm.byClient[sub.ClientID]) == 0 {
+		delete(sm.byClient, sub.ClientID)
+	}
+}
+
 func (sm *SubscriptionManager) Get(clientID string, subID string) (Subscription, error) {
-	internalSubID := clientID + "_" + subID
-	sub, prs := sm.Subscriptions[internalSubID]
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sub, prs := sm.byClient[clientID][subID]
 	if prs {
 		return sub, nil
 	} else {
@@ -62,20 +112,14 @@ func (sm *SubscriptionManager) Get(clientID string, subID string) (Subscription,
 	}
 }
 
+// ClientsByDestination returns a copy of the subscriptions to dest, which the caller may keep and reorder
 func (sm *SubscriptionManager) ClientsByDestination(dest string) []Subscription {
-	// loop for now
-	// could see this being expensive
-	// might be better to just maintain a map keyed by internal ID
-	// and one keyed by destination
-	// so lookup is O(1) or O(nlogn) or something like that
-	// adding is worst-case O(n), and removing is O(1)
-
-	clients := make([]Subscription, 0)
-	for k := range sm.Subscriptions {
-		sub := sm.Subscriptions[k]
-		if sub.Destination == dest {
-			clients = append(clients, sub)
-		}
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	clients := make([]Subscription, 0, len(sm.byDestination[dest]))
+	for _, sub := range sm.byDestination[dest] {
+		clients = append(clients, sub)
 	}
 	return clients
 }
@@ -84,6 +128,7 @@ type Subscription struct {
 	ID          string
 	Destination string
 	ClientID    string
+	AckMode     string
 }
 
 func (s *Subscription) InternalSubID() string {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"sync"
 	"testing"
 
 	// "reflect"
@@ -18,7 +20,7 @@ func TestSubscriptionManager(t *testing.T) {
 
 	// sm.Subscribe
 	t.Run("_Subscribe", func(t *testing.T) {
-		err := sm.Subscribe(clientID, subID, dest)
+		err := sm.Subscribe(clientID, subID, dest, ACK_AUTO)
 		if err != nil {
 			t.Errorf("Subscription error: %v\n", err)
 		}
@@ -29,7 +31,7 @@ func TestSubscriptionManager(t *testing.T) {
 			t.Errorf("Subscription added incorrectly.")
 		}
 
-		err = sm.Subscribe(clientID, subID, dest)
+		err = sm.Subscribe(clientID, subID, dest, ACK_AUTO)
 		if err == nil {
 			t.Errorf("Duplicate subscription allowed.")
 		}
@@ -50,7 +52,7 @@ func TestSubscriptionManager(t *testing.T) {
 
 	// sm.Get
 	t.Run("_Get", func(t *testing.T) {
-		err := sm.Subscribe(clientID, subID, dest)
+		err := sm.Subscribe(clientID, subID, dest, ACK_AUTO)
 		if err != nil {
 			t.Errorf("Subscription error: %v\n", err)
 		}
@@ -66,7 +68,7 @@ func TestSubscriptionManager(t *testing.T) {
 	})
 
 	t.Run("_UnsubscribeAll", func(t *testing.T) {
-		err := sm.Subscribe(clientID, subID2, dest)
+		err := sm.Subscribe(clientID, subID2, dest, ACK_AUTO)
 		if err != nil {
 			t.Error("Subscription error: ", err)
 		}
@@ -101,7 +103,7 @@ func TestSubscriptionManagerGetByDestination(t *testing.T) {
 		testname := fmt.Sprintf("%v\n", tt.subs)
 		t.Run(testname, func(t *testing.T) {
 			for _, sub := range tt.subs {
-				err := sm.Subscribe(sub.ClientID, sub.ID, sub.Destination)
+				err := sm.Subscribe(sub.ClientID, sub.ID, sub.Destination, ACK_AUTO)
 				if err != nil {
 					t.Errorf("Subscription error: %v\n", err)
 				}
@@ -114,3 +116,98 @@ func TestSubscriptionManagerGetByDestination(t *testing.T) {
 		})
 	}
 }
+
+func TestSubscriptionManagerUnsubscribeAllPrefix(t *testing.T) {
+	sm := NewSubscriptionManager()
+	err := sm.Subscribe("client", "0", "/queue/test", ACK_AUTO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sm.Subscribe("client2", "0", "/queue/test", ACK_AUTO)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm.UnsubscribeAll("client")
+
+	_, err = sm.Get("client2", "0")
+	if err != nil {
+		t.Error("UnsubscribeAll removed another client's subscription")
+	}
+	if n := len(sm.ClientsByDestination("/queue/test")); n != 1 {
+		t.Errorf("got %d subscriptions to destination wanted 1", n)
+	}
+}
+
+// run with -race (make race-test) to check the locking
+func TestSubscriptionManagerConcurrent(t *testing.T) {
+	sm := NewSubscriptionManager()
+	dest := "/queue/test"
+	clients := 8
+	subs := 50
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// the dispatch loop reads while the engine subscribes and unsubscribes
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, sub := range sm.ClientsByDestination(dest) {
+				if sub.Destination != dest {
+					t.Errorf("subscription to %s returned for %s", sub.Destination, dest)
+				}
+			}
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		writers.Add(1)
+		go func(clientID string) {
+			defer writers.Done()
+			for i := 0; i < subs; i++ {
+				subID := strconv.Itoa(i)
+				err := sm.Subscribe(clientID, subID, dest, ACK_AUTO)
+				if err != nil {
+					t.Error(err)
+				}
+				if i%2 == 1 {
+					err = sm.Unsubscribe(clientID, subID)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}("client" + strconv.Itoa(c))
+	}
+	writers.Wait()
+
+	if n := len(sm.ClientsByDestination(dest)); n != clients*subs/2 {
+		t.Errorf("got %d subscriptions wanted %d", n, clients*subs/2)
+	}
+
+	for c := 0; c < clients; c++ {
+		writers.Add(1)
+		go func(clientID string) {
+			defer writers.Done()
+			sm.UnsubscribeAll(clientID)
+		}("client" + strconv.Itoa(c))
+	}
+	writers.Wait()
+	close(done)
+	wg.Wait()
+
+	if n := len(sm.ClientsByDestination(dest)); n != 0 {
+		t.Errorf("got %d subscriptions after UnsubscribeAll wanted 0", n)
+	}
+	if len(sm.Subscriptions) != 0 || len(sm.byDestination) != 0 || len(sm.byClient) != 0 {
+		t.Errorf("indexes not emptied: %d %d %d", len(sm.Subscriptions), len(sm.byDestination), len(sm.byClient))
+	}
+}
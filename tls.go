@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// client certificate modes for ConfigureClientAuth
+const (
+	CLIENT_AUTH_NONE    = "none"    // no client certificate is asked for
+	CLIENT_AUTH_REQUEST = "request" // a client certificate is verified if one is sent
+	CLIENT_AUTH_REQUIRE = "require" // handshakes without a valid client certificate fail
+)
+
+// certificate fields a client's principal can be taken from
+const (
+	CERT_PRINCIPAL_CN  = "cn"  // the subject common name
+	CERT_PRINCIPAL_SAN = "san" // the first DNS name, email address or URI subject alternative name
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig loads a certificate and key for serving TLS.
+// minVersion is one of 1.0, 1.1, 1.2 or 1.3, and defaults to 1.2 when empty.
+// cipherSuites names the TLS 1.0-1.2 suites to allow, as listed by tls.CipherSuites;
+// when empty, Go's default secure suites are used. TLS 1.3 suites are not configurable.
+func NewTLSConfig(certFile, keyFile, minVersion string, cipherSuites []string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, prs := tlsVersions[minVersion]
+	if !prs {
+		return nil, fmt.Errorf("unknown TLS version %s, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+
+	var suites []uint16
+	for _, name := range cipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, id)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		CipherSuites: suites,
+	}, nil
+}
+
+// cipherSuiteID looks up a cipher suite by name, refusing suites Go considers insecure
+func cipherSuiteID(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, nil
+		}
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %s", name)
+}
+
+// ConfigureClientAuth sets how config asks for client certificates, verifying them against the PEM CA bundle in caFile
+func ConfigureClientAuth(config *tls.Config, mode, caFile string) error {
+	switch mode {
+	case "", CLIENT_AUTH_NONE:
+		config.ClientAuth = tls.NoClientCert
+		return nil
+	case CLIENT_AUTH_REQUEST:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRE:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client auth mode %s, expected none, request or require", mode)
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.ClientCAs = pool
+	return nil
+}
+
+// certPrincipal returns the name a verified client certificate authenticates as, or an empty string if it has none
+func certPrincipal(cert *x509.Certificate, from string) string {
+	if from == CERT_PRINCIPAL_SAN {
+		switch {
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0]
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String()
+		}
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+func validateCertPrincipal(from string) error {
+	switch from {
+	case CERT_PRINCIPAL_CN, CERT_PRINCIPAL_SAN:
+		return nil
+	}
+	return fmt.Errorf("unknown certificate principal field %s, expected cn or san", from)
+}
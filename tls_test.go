@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a certificate for cn, self-signed if parent is nil
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = &template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeTestCert writes a certificate and its key as PEM files named after name in dir
+func writeTestCert(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// writeServerCert writes a self-signed certificate and key for localhost to dir
+func writeServerCert(t *testing.T, dir string) (string, string) {
+	cert, key := newTestCert(t, "localhost", nil, nil, x509.ExtKeyUsageServerAuth)
+	return writeTestCert(t, dir, "server", cert, key)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := writeServerCert(t, t.TempDir())
+
+	config, err := NewTLSConfig(certFile, keyFile, "", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got min version %x wanted %x", config.MinVersion, tls.VersionTLS12)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("got cipher suites %v", config.CipherSuites)
+	}
+
+	errTests := map[string]struct {
+		minVersion string
+		suites     []string
+	}{
+		"unknown version": {"2.0", nil},
+		"unknown suite":   {"1.2", []string{"TLS_NOT_A_SUITE"}},
+		"insecure suite":  {"1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+	}
+	for name, tc := range errTests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewTLSConfig(certFile, keyFile, tc.minVersion, tc.suites)
+			if err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestConnectionManagerTLS(t *testing.T) {
+	certFile, keyFile := writeServerCert(t, t.TempDir())
+	messages := make(chan CnxMgrMsg)
+	cm := NewConnectionManager("", 32802, messages, 1)
+	err := cm.AddListener(ListenerConfig{Type: LISTENER_TCP, Address: ":32802"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.AddListener(ListenerConfig{Type: LISTENER_TLS, Address: ":32803", CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.Start()
+	if err != nil {
+		t.Fatal("error starting cnx manager: ", err)
+	}
+	defer cm.Stop()
+
+	conn, err := tls.Dial("tcp", "localhost:32803", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("could not connect to TLS listener: ", err)
+	}
+	<-messages
+
+	_, err = conn.Write([]byte("CONNECT\naccept-version:1.2\n\n\000"))
+	if err != nil {
+		t.Fatal("write error: ", err)
+	}
+	msg := <-messages
+	if msg.Type != FRAME || msg.Err != nil || msg.Frame.Command != CONNECT {
+		t.Errorf("did not receive CONNECT frame over TLS: %+v", msg)
+	}
+	conn.Close()
+	<-messages
+
+	// plaintext is still served on the main port
+	plain, err := net.Dial("tcp", "localhost:32802")
+	if err != nil {
+		t.Fatal("could not connect to plaintext listener: ", err)
+	}
+	<-messages
+
+	_, err = plain.Write([]byte("CONNECT\naccept-version:1.2\n\n\000"))
+	if err != nil {
+		t.Fatal("write error: ", err)
+	}
+	msg = <-messages
+	if msg.Type != FRAME || msg.Err != nil || msg.Frame.Command != CONNECT {
+		t.Errorf("did not receive CONNECT frame over plaintext: %+v", msg)
+	}
+	plain.Close()
+	<-messages
+}
+
+func TestConnectionManagerClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeServerCert(t, dir)
+	ca, caKey := newTestCert(t, "test-ca", nil, nil, x509.ExtKeyUsageClientAuth)
+	caFile, _ := writeTestCert(t, dir, "ca", ca, caKey)
+	client, clientKey := newTestCert(t, "orders-service", ca, caKey, x509.ExtKeyUsageClientAuth)
+	untrusted, untrustedKey := newTestCert(t, "intruder", nil, nil, x509.ExtKeyUsageClientAuth)
+
+	messages := make(chan CnxMgrMsg)
+	cm := NewConnectionManager("", 32804, messages, 1)
+	err := cm.AddListener(ListenerConfig{
+		Type:         LISTENER_TLS,
+		Address:      ":32804",
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientAuth:   CLIENT_AUTH_REQUIRE,
+		ClientCAFile: caFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.Start()
+	if err != nil {
+		t.Fatal("error starting cnx manager: ", err)
+	}
+	defer cm.Stop()
+
+	dial := func(cert *x509.Certificate, key *ecdsa.PrivateKey) {
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		conn, err := tls.Dial("tcp", "localhost:32804", clientConfig)
+		if err != nil {
+			return
+		}
+		// with TLS 1.3 the client learns its certificate was refused on its first read
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	t.Run("_Verified", func(t *testing.T) {
+		go dial(client, clientKey)
+		msg := <-messages
+		if msg.Type != NEW_CONNECTION {
+			t.Fatalf("expected NEW_CONNECTION, got %+v", msg)
+		}
+		if peer := cm.Peer(msg.ID); peer != "orders-service" {
+			t.Errorf("got peer %q wanted orders-service", peer)
+		}
+		cm.Close(msg.ID)
+		<-messages
+	})
+
+	for name, cert := range map[string]*x509.Certificate{"_NoCert": nil, "_Untrusted": untrusted} {
+		t.Run(name, func(t *testing.T) {
+			go dial(cert, untrustedKey)
+			msg := <-messages
+			if msg.Type != HANDSHAKE_FAILED || msg.Err == nil || msg.Msg == "" {
+				t.Errorf("expected HANDSHAKE_FAILED with remote address, got %+v", msg)
+			}
+		})
+	}
+}
+
+func TestCertPrincipal(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "common"},
+		EmailAddresses: []string{"svc@example.com"},
+	}
+	if got := certPrincipal(cert, CERT_PRINCIPAL_CN); got != "common" {
+		t.Errorf("got %q wanted common", got)
+	}
+	if got := certPrincipal(cert, CERT_PRINCIPAL_SAN); got != "svc@example.com" {
+		t.Errorf("got %q wanted svc@example.com", got)
+	}
+	if got := certPrincipal(&x509.Certificate{}, CERT_PRINCIPAL_SAN); got != "" {
+		t.Errorf("got %q wanted empty", got)
+	}
+}
@@ -2,23 +2,42 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"time"
 )
 
+// Transaction holds the SEND, ACK and NACK frames a client has sent with its transaction header,
+// in the order they were sent, until the transaction is committed or aborted
 type Transaction struct {
-	frames []Frame
+	id           string
+	connectionID string
+	frames       []Frame
+	expires      time.Time // zero if the transaction never times out
 }
 
+// TransactionManager is only used from the engine's main loop, so it needs no locking
 type TransactionManager struct {
 	transactions map[string]Transaction
+	timeout      time.Duration // 0 means transactions never time out
+	maxFrames    int           // 0 means no limit
+	now          func() time.Time
 }
 
 func NewTransactionManager() *TransactionManager {
 	return &TransactionManager{
 		transactions: make(map[string]Transaction),
+		now:          time.Now,
 	}
 }
 
+// SetLimits aborts transactions left open longer than timeout, and any transaction that
+// would hold more than maxFrames frames. Zero disables either limit.
+func (tm *TransactionManager) SetLimits(timeout time.Duration, maxFrames int) {
+	tm.timeout = timeout
+	tm.maxFrames = maxFrames
+}
+
 // StartTransaction is called when engine interprets a BEGIN frame
 // adds a new transaction to the map iff no transaction with this id for this client exists
 func (tm *TransactionManager) StartTransaction(id, connectionID string) error {
@@ -28,9 +47,15 @@ func (tm *TransactionManager) StartTransaction(id, connectionID string) error {
 		return errors.New("transaction with this ID already exists")
 	}
 
-	tm.transactions[internalTxId] = Transaction{
-		frames: []Frame{},
+	tx := Transaction{
+		id:           id,
+		connectionID: connectionID,
+		frames:       []Frame{},
+	}
+	if tm.timeout > 0 {
+		tx.expires = tm.now().Add(tm.timeout)
 	}
+	tm.transactions[internalTxId] = tx
 
 	log.Printf("client %s: created transaction %s\n", connectionID, id)
 
@@ -41,54 +66,91 @@ func (tm *TransactionManager) StartTransaction(id, connectionID string) error {
 // it pulls the transaction by its ID and the client's ID, then sends the Transaction as one unit
 // on the provided channel, at which point the Engine handles SENDing the messages
 func (tm *TransactionManager) CommitTransaction(id, connectionID string) (Transaction, error) {
-	internalTxId := internalTxId(id, connectionID)
-	tx, ok := tm.transactions[internalTxId]
-
-	if ok {
-		defer delete(tm.transactions, internalTxId)
-		log.Printf("client %s: enacted commit for transaction %s\n", connectionID, id)
-		return tx, nil
+	tx, err := tm.get(id, connectionID)
+	if err != nil {
+		return Transaction{}, err
 	}
 
-	return Transaction{}, errors.New("no such transaction found")
+	delete(tm.transactions, internalTxId(id, connectionID))
+	log.Printf("client %s: enacted commit for transaction %s\n", connectionID, id)
+	return tx, nil
 }
 
 // AbortTransaction is called when the engine handles an ABORT frame
 // it pulls the transaction by its ID and the client's ID and deletes it
 func (tm *TransactionManager) AbortTransaction(id, connectionID string) error {
-	internalTxId := internalTxId(id, connectionID)
-	_, ok := tm.transactions[internalTxId]
-
-	if ok {
-		delete(tm.transactions, internalTxId)
-	} else {
-		return errors.New("no such transaction found")
+	_, err := tm.get(id, connectionID)
+	if err != nil {
+		return err
 	}
 
+	delete(tm.transactions, internalTxId(id, connectionID))
 	log.Printf("client %s: aborted transaction %s\n", connectionID, id)
 
 	return nil
 }
 
+// AbortAll aborts every transaction a client has open, e.g. when its connection closes
+func (tm *TransactionManager) AbortAll(connectionID string) {
+	for k, tx := range tm.transactions {
+		if tx.connectionID == connectionID {
+			delete(tm.transactions, k)
+			log.Printf("client %s: aborted transaction %s on close\n", connectionID, tx.id)
+		}
+	}
+}
+
+// Expire aborts every transaction that has been open longer than the timeout
+func (tm *TransactionManager) Expire() {
+	now := tm.now()
+	for k, tx := range tm.transactions {
+		if tx.expired(now) {
+			delete(tm.transactions, k)
+			log.Printf("TRANSACTION_TIMEOUT: client %s: aborted transaction %s\n", tx.connectionID, tx.id)
+		}
+	}
+}
+
 // AddFrame is called by the engine when it handles a frame that includes a transaction id header
 // the frame is added iff a matching tx has been BEGINed by the same client
 func (tm *TransactionManager) AddFrame(id, connectionID string, frame Frame) error {
-	internalTxId := internalTxId(id, connectionID)
+	tx, err := tm.get(id, connectionID)
+	if err != nil {
+		return err
+	}
 
-	tx, ok := tm.transactions[internalTxId]
-	if ok {
-		tm.transactions[internalTxId] = Transaction{
-			frames: append(tx.frames, frame),
-		}
-	} else {
-		return errors.New("no such transaction found")
+	internalTxId := internalTxId(id, connectionID)
+	if tm.maxFrames > 0 && len(tx.frames) >= tm.maxFrames {
+		delete(tm.transactions, internalTxId)
+		return fmt.Errorf("transaction %s exceeded %d frames and was aborted", id, tm.maxFrames)
 	}
+	tx.frames = append(tx.frames, frame)
+	tm.transactions[internalTxId] = tx
 
 	log.Printf("client %s: added frame to transaction %s\n", connectionID, id)
 
 	return nil
 }
 
+// get returns an open transaction, aborting it instead if it has timed out
+func (tm *TransactionManager) get(id, connectionID string) (Transaction, error) {
+	internalTxId := internalTxId(id, connectionID)
+	tx, ok := tm.transactions[internalTxId]
+	if !ok {
+		return Transaction{}, errors.New("no such transaction found")
+	}
+	if tx.expired(tm.now()) {
+		delete(tm.transactions, internalTxId)
+		log.Printf("TRANSACTION_TIMEOUT: client %s: aborted transaction %s\n", connectionID, id)
+		return Transaction{}, fmt.Errorf("transaction %s timed out and was aborted", id)
+	}
+	return tx, nil
+}
+
+func (tx Transaction) expired(now time.Time) bool {
+	return !tx.expires.IsZero() && now.After(tx.expires)
+}
+
 // internalTxId is used to return a consistent name for a given transaction
 func internalTxId(id, connectionID string) string {
 	return id + "_" + connectionID
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactionManager(t *testing.T) {
+	fr := Frame{Command: SEND, Headers: map[string]string{"destination": "/queue/test"}, Body: []byte{}}
+
+	t.Run("_AbortAll", func(t *testing.T) {
+		tm := NewTransactionManager()
+		tm.StartTransaction("tx1", "client1")
+		tm.StartTransaction("tx2", "client1")
+		tm.StartTransaction("tx1", "client2")
+
+		tm.AbortAll("client1")
+		if len(tm.transactions) != 1 {
+			t.Errorf("got %d open transactions wanted 1", len(tm.transactions))
+		}
+		_, err := tm.CommitTransaction("tx1", "client2")
+		if err != nil {
+			t.Error("another client's transaction was aborted: ", err)
+		}
+	})
+
+	t.Run("_MaxFrames", func(t *testing.T) {
+		tm := NewTransactionManager()
+		tm.SetLimits(0, 2)
+		tm.StartTransaction("tx1", "client1")
+		for i := 0; i < 2; i++ {
+			err := tm.AddFrame("tx1", "client1", fr)
+			if err != nil {
+				t.Fatal("add error: ", err)
+			}
+		}
+		err := tm.AddFrame("tx1", "client1", fr)
+		if err == nil {
+			t.Error("allowed more frames than the limit")
+		}
+		_, err = tm.CommitTransaction("tx1", "client1")
+		if err == nil {
+			t.Error("transaction over the limit was not aborted")
+		}
+	})
+
+	t.Run("_Timeout", func(t *testing.T) {
+		now := time.Now()
+		tm := NewTransactionManager()
+		tm.now = func() time.Time { return now }
+		tm.SetLimits(time.Minute, 0)
+		tm.StartTransaction("tx1", "client1")
+		tm.StartTransaction("tx2", "client1")
+
+		now = now.Add(30 * time.Second)
+		tm.StartTransaction("tx3", "client1")
+		err := tm.AddFrame("tx1", "client1", fr)
+		if err != nil {
+			t.Error("add error before timeout: ", err)
+		}
+
+		now = now.Add(31 * time.Second)
+		err = tm.AddFrame("tx1", "client1", fr)
+		if err == nil {
+			t.Error("timed out transaction still open")
+		}
+		tm.Expire()
+		if _, prs := tm.transactions[internalTxId("tx2", "client1")]; prs {
+			t.Error("Expire left a timed out transaction open")
+		}
+		_, err = tm.CommitTransaction("tx3", "client1")
+		if err != nil {
+			t.Error("transaction expired early: ", err)
+		}
+	})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// design notes:
+// * browsers speak STOMP over WebSocket, one STOMP frame per WebSocket message
+// * a WebSocket is adapted into a net.Conn carrying the concatenated message payloads,
+//   so the ConnectionManager can read and write it exactly like a TCP connection
+// * only the parts of RFC 6455 a STOMP server needs are implemented: no extensions or compression
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// subprotocols in order of preference
+var wsSubprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// wsListener accepts WebSocket upgrades over HTTP and hands each one out as a net.Conn
+type wsListener struct {
+	tcp    net.Listener
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newWSListener serves WebSocket upgrades on path over l
+func newWSListener(l net.Listener, path string) *wsListener {
+	wl := &wsListener{
+		tcp:   l,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, wl.upgrade)
+	wl.server = &http.Server{Handler: mux}
+	go wl.server.Serve(l)
+	return wl
+}
+
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (wl *wsListener) Close() error {
+	wl.once.Do(func() { close(wl.done) })
+	return wl.server.Close()
+}
+
+func (wl *wsListener) Addr() net.Addr {
+	return wl.tcp.Addr()
+}
+
+// upgrade completes the opening handshake of RFC 6455 section 4.2
+func (wl *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "no Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	protocol := selectSubprotocol(r.Header)
+	if protocol == "" {
+		http.Error(w, "expected a STOMP subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade connection", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("WEBSOCKET_ERROR: hijack from remote address %s: %v\n", r.RemoteAddr, err)
+		return
+	}
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\n")
+	brw.WriteString("Connection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n")
+	brw.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n")
+	err = brw.Flush()
+	if err != nil {
+		log.Printf("WEBSOCKET_ERROR: handshake to remote address %s: %v\n", r.RemoteAddr, err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case wl.conns <- newWSConn(conn, brw.Reader):
+	case <-wl.done:
+		conn.Close()
+	}
+}
+
+// wsAccept computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// selectSubprotocol picks the most preferred STOMP subprotocol the client offered
+func selectSubprotocol(header http.Header) string {
+	offered := map[string]bool{}
+	for _, v := range header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			offered[strings.TrimSpace(p)] = true
+		}
+	}
+	for _, p := range wsSubprotocols {
+		if offered[p] {
+			return p
+		}
+	}
+	return ""
+}
+
+// headerContains reports whether the comma separated header key contains token, ignoring case
+func headerContains(header http.Header, key, token string) bool {
+	for _, v := range header.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a net.Conn over a WebSocket: Read returns the payloads of data messages in order,
+// and each Write is sent as one message
+type wsConn struct {
+	net.Conn
+	r         *bufio.Reader
+	remaining uint64 // unread payload bytes in the current data frame
+	mask      [4]byte
+	maskPos   int
+	final     bool // the current data frame ends its message
+	wmu       sync.Mutex
+	closed    bool // a close frame has been sent; guarded by wmu
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader) *wsConn {
+	return &wsConn{
+		Conn:  conn,
+		r:     r,
+		final: true,
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % 4
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until the start of a data frame, answering control frames on the way
+func (c *wsConn) nextFrame() error {
+	for {
+		var head [2]byte
+		_, err := io.ReadFull(c.r, head[:])
+		if err != nil {
+			return err
+		}
+		fin := head[0]&0x80 != 0
+		opcode := head[0] & 0x0F
+		if head[0]&0x70 != 0 {
+			return c.fail(1002, "reserved bits set")
+		}
+		if head[1]&0x80 == 0 {
+			return c.fail(1002, "client frames must be masked")
+		}
+
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			_, err = io.ReadFull(c.r, ext[:])
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			_, err = io.ReadFull(c.r, ext[:])
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(c.r, c.mask[:])
+		if err != nil {
+			return err
+		}
+		c.maskPos = 0
+
+		switch opcode {
+		case wsText, wsBinary, wsContinuation:
+			if (opcode == wsContinuation) == c.final {
+				return c.fail(1002, "data frame out of sequence")
+			}
+			c.final = fin
+			c.remaining = length
+			if length > 0 {
+				return nil
+			}
+		case wsClose, wsPing, wsPong:
+			if !fin || length > 125 {
+				return c.fail(1002, "invalid control frame")
+			}
+			payload := make([]byte, length)
+			_, err = io.ReadFull(c.r, payload)
+			if err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] ^= c.mask[i%4]
+			}
+			switch opcode {
+			case wsClose:
+				// echo the status code back, then treat the WebSocket as closed
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+				c.writeFrame(wsClose, payload)
+				return io.EOF
+			case wsPing:
+				err = c.writeFrame(wsPong, payload)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return c.fail(1002, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+	}
+}
+
+// fail closes the WebSocket with a status code after a protocol error
+func (c *wsConn) fail(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	c.writeFrame(wsClose, append(payload, reason...))
+	return errors.New("websocket: " + reason)
+}
+
+// Write sends p as a single message, as text if it is valid UTF-8 and binary otherwise
+func (c *wsConn) Write(p []byte) (int, error) {
+	opcode := byte(wsText)
+	if !utf8.Valid(p) {
+		opcode = wsBinary
+	}
+	err := c.writeFrame(opcode, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+
+	// server frames are never masked
+	var head []byte
+	switch {
+	case len(payload) < 126:
+		head = []byte{0, byte(len(payload))}
+	case len(payload) <= 0xFFFF:
+		head = make([]byte, 4, 4+len(payload))
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(len(payload)))
+	default:
+		head = make([]byte, 10, 10+len(payload))
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(len(payload)))
+	}
+	head[0] = 0x80 | opcode
+	_, err := c.Conn.Write(append(head, payload...))
+	return err
+}
+
+// Close sends a normal closure frame, if one has not been sent yet, and closes the connection
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000: normal closure
+	return c.Conn.Close()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// wsDial opens a WebSocket to addr offering protocols, returning the connection and the handshake response
+func wsDial(t *testing.T, addr, path, protocols string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("could not connect to server: ", err)
+	}
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + protocols + "\r\n\r\n"
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		t.Fatal("write error: ", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal("could not read handshake response: ", err)
+	}
+	return conn, r, resp
+}
+
+// wsWriteFrame writes a masked client frame
+func wsWriteFrame(t *testing.T, conn net.Conn, fin bool, opcode byte, payload []byte) {
+	head := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		head[0] |= 0x80
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	_, err := conn.Write(append(append(head, mask...), masked...))
+	if err != nil {
+		t.Fatal("write error: ", err)
+	}
+}
+
+// wsReadFrame reads an unmasked server frame
+func wsReadFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		t.Fatal("read error: ", err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		t.Fatal("read error: ", err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestWSAccept(t *testing.T) {
+	// the example from RFC 6455 section 1.3
+	got := wsAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	if got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got %s wanted s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", got)
+	}
+}
+
+func TestConnectionManagerWebSocket(t *testing.T) {
+	messages := make(chan CnxMgrMsg)
+	cm := NewConnectionManager("", 32805, messages, 1)
+	err := cm.AddListener(ListenerConfig{Type: LISTENER_WEBSOCKET, Address: ":32806", Path: "/stomp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cm.Start()
+	if err != nil {
+		t.Fatal("error starting cnx manager: ", err)
+	}
+	defer cm.Stop()
+
+	t.Run("_NoSubprotocol", func(t *testing.T) {
+		conn, _, resp := wsDial(t, "localhost:32806", "/stomp", "chat")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d wanted %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("_Frames", func(t *testing.T) {
+		conn, r, resp := wsDial(t, "localhost:32806", "/stomp", "v10.stomp, v12.stomp")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("got status %d wanted %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "v12.stomp" {
+			t.Errorf("got subprotocol %s wanted v12.stomp", p)
+		}
+		msg := <-messages
+		if msg.Type != NEW_CONNECTION {
+			t.Fatalf("expected NEW_CONNECTION, got %+v", msg)
+		}
+		id := msg.ID
+
+		// a fragmented message with a ping between its fragments
+		wsWriteFrame(t, conn, false, wsText, []byte("CONNECT\naccept-"))
+		wsWriteFrame(t, conn, true, wsPing, []byte("hi"))
+		wsWriteFrame(t, conn, true, wsContinuation, []byte("version:1.2\n\n\000"))
+
+		opcode, payload := wsReadFrame(t, r)
+		if opcode != wsPong || string(payload) != "hi" {
+			t.Errorf("expected pong, got opcode %d payload %q", opcode, payload)
+		}
+		msg = <-messages
+		if msg.Type != FRAME || msg.Err != nil || msg.Frame.Command != CONNECT || msg.Frame.Headers["accept-version"] != "1.2" {
+			t.Errorf("did not receive CONNECT frame: %+v", msg)
+		}
+
+		frame := "CONNECTED\nversion:1.2\n\n\000"
+		err := cm.Write(id, []byte(frame))
+		if err != nil {
+			t.Fatal("write error: ", err)
+		}
+		opcode, payload = wsReadFrame(t, r)
+		if opcode != wsText || string(payload) != frame {
+			t.Errorf("expected one text message with the frame, got opcode %d payload %q", opcode, payload)
+		}
+
+		wsWriteFrame(t, conn, true, wsClose, []byte{0x03, 0xE8})
+		opcode, _ = wsReadFrame(t, r)
+		if opcode != wsClose {
+			t.Errorf("expected close frame, got opcode %d", opcode)
+		}
+		msg = <-messages
+		if msg.Type != CONNECTION_CLOSED || msg.ID != id {
+			t.Errorf("expected CONNECTION_CLOSED, got %+v", msg)
+		}
+	})
+}